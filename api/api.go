@@ -3,15 +3,28 @@
 
 package api
 
+import (
+	"context"
+	"errors"
+)
+
 // API is the interface for different panel's api.
 type API interface {
-	GetNodeInfo() (nodeInfo *NodeInfo, err error)
-	GetUserList() (userList *[]UserInfo, err error)
-	ReportNodeStatus(nodeStatus *NodeStatus) (err error)
-	ReportNodeOnlineUsers(onlineUser *[]OnlineUser) (err error)
-	ReportUserTraffic(userTraffic *[]UserTraffic) (err error)
+	GetNodeInfo(ctx context.Context) (nodeInfo *NodeInfo, err error)
+	GetUserList(ctx context.Context) (userList *[]UserInfo, err error)
+	ReportNodeStatus(ctx context.Context, nodeStatus *NodeStatus) (err error)
+	ReportNodeOnlineUsers(ctx context.Context, onlineUser *[]OnlineUser) (err error)
+	ReportUserTraffic(ctx context.Context, userTraffic *[]UserTraffic) (err error)
 	Describe() ClientInfo
-	GetNodeRule() (ruleList *[]DetectRule, err error)
-	ReportIllegal(detectResultList *[]DetectResult) (err error)
+	GetNodeRule(ctx context.Context) (ruleList *[]DetectRule, err error)
+	ReportIllegal(ctx context.Context, detectResultList *[]DetectResult) (err error)
 	Debug()
 }
+
+// ErrSuspiciousEmptyList is returned by GetUserList when RejectEmptyUserList is enabled
+// and the panel returns an empty user list right after a non-empty one.
+var ErrSuspiciousEmptyList = errors.New("the panel returned an empty user list after a non-empty one")
+
+// ErrNodeInfoNotModified is returned by GetNodeInfo together with the cached node info
+// when the panel answers 304 Not Modified, so the caller can skip rebuilding the inbound.
+var ErrNodeInfoNotModified = errors.New("the node info is not modified")
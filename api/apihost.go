@@ -0,0 +1,34 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// NormalizeAPIHost adds https:// to an APIHost without a scheme, strips the trailing slash
+// and checks the result is a http or https url with a host. A unix socket APIHost is returned as is.
+func NormalizeAPIHost(apiHost string) (string, error) {
+	if _, ok := UnixSocketPath(apiHost); ok {
+		return apiHost, nil
+	}
+	host := strings.TrimSpace(apiHost)
+	if host == "" {
+		return "", fmt.Errorf("ApiHost is empty")
+	}
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	host = strings.TrimRight(host, "/")
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid ApiHost %q: %s", apiHost, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid ApiHost %q: unsupported scheme %q, use http or https", apiHost, u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid ApiHost %q: missing host", apiHost)
+	}
+	return host, nil
+}
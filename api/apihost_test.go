@@ -0,0 +1,32 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestNormalizeAPIHost(t *testing.T) {
+	cases := []struct {
+		raw  string
+		host string
+	}{
+		{"panel.example.com", "https://panel.example.com"},
+		{"panel.example.com:8443/", "https://panel.example.com:8443"},
+		{"http://127.0.0.1:667/", "http://127.0.0.1:667"},
+		{"https://panel.example.com/mod_mu//", "https://panel.example.com/mod_mu"},
+		{"unix:///run/panel.sock", "unix:///run/panel.sock"},
+	}
+	for _, c := range cases {
+		host, err := api.NormalizeAPIHost(c.raw)
+		if err != nil || host != c.host {
+			t.Errorf("NormalizeAPIHost(%q) = %q, %v, want %q", c.raw, host, err, c.host)
+		}
+	}
+
+	for _, raw := range []string{"", " ", "/", "http://", "https://pa nel.example.com", "ftp://panel.example.com"} {
+		if host, err := api.NormalizeAPIHost(raw); err == nil {
+			t.Errorf("NormalizeAPIHost(%q) = %q, expected an error", raw, host)
+		}
+	}
+}
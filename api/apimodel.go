@@ -1,27 +1,65 @@
 package api
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+)
 
 // API config
 type Config struct {
-	APIHost      string  `mapstructure:"ApiHost"`
-	NodeID       int     `mapstructure:"NodeID"`
-	Key          string  `mapstructure:"ApiKey"`
-	NodeType     string  `mapstructure:"NodeType"`
-	EnableVless  bool    `mapstructure:"EnableVless"`
-	EnableXTLS   bool    `mapstructure:"EnableXTLS"`
-	Timeout      int     `mapstructure:"Timeout"`
-	SpeedLimit   float64 `mapstructure:"SpeedLimit"`
-	DeviceLimit  int     `mapstructure:"DeviceLimit"`
-	RuleListPath string  `mapstructure:"RuleListPath"`
+	APIHost             string            `mapstructure:"ApiHost"`
+	NodeID              int               `mapstructure:"NodeID"`
+	Key                 string            `mapstructure:"ApiKey"`
+	NodeType            string            `mapstructure:"NodeType"`
+	EnableVless         bool              `mapstructure:"EnableVless"`
+	EnableXTLS          bool              `mapstructure:"EnableXTLS"`
+	Timeout             int               `mapstructure:"Timeout"`
+	SpeedLimit          float64           `mapstructure:"SpeedLimit"`
+	DeviceLimit         int               `mapstructure:"DeviceLimit"`
+	RuleListPath        string            `mapstructure:"RuleListPath"`
+	RejectEmptyUserList bool              `mapstructure:"RejectEmptyUserList"`
+	DryRun              bool              `mapstructure:"DryRun"`
+	HashReportedIPs     bool              `mapstructure:"HashReportedIPs"`
+	HashSalt            string            `mapstructure:"HashSalt"`
+	PinnedCertSHA256    string            `mapstructure:"PinnedCertSHA256"`
+	DefaultTransport    string            `mapstructure:"DefaultTransport"`
+	RetryCount          int               `mapstructure:"RetryCount"`
+	RetryWaitTime       int               `mapstructure:"RetryWaitTime"`
+	RetryPolicy         RetryPolicy       `mapstructure:"RetryPolicy"`
+	RetryJitter         int               `mapstructure:"RetryJitter"`
+	MaxRedirects        int               `mapstructure:"MaxRedirects"`
+	RuleCacheTTL        int               `mapstructure:"RuleCacheTTL"`
+	OnlineWindow        int               `mapstructure:"OnlineWindow"`
+	IllegalCooldown     int               `mapstructure:"IllegalCooldown"`
+	ReportTemperature   bool              `mapstructure:"ReportTemperature"`
+	TemperaturePath     string            `mapstructure:"TemperaturePath"`
+	TrafficBatchSize    int               `mapstructure:"TrafficBatchSize"`
+	HTTPClient          *http.Client      `mapstructure:"-" json:"-"` // Optional, the base http client, Transport, PinnedCertSHA256 and a unix socket ApiHost are applied on top of it
+	Transport           http.RoundTripper `mapstructure:"-" json:"-"` // Optional, replaces the default http transport
+	RuleProvider        RuleProvider      `mapstructure:"-" json:"-"` // Optional, replaces the rules read from RuleListPath
+}
+
+// Redacted returns a copy of the config with the secrets masked, safe for sharing
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.Key != "" {
+		redacted.Key = "<redacted>"
+	}
+	if redacted.HashSalt != "" {
+		redacted.HashSalt = "<redacted>"
+	}
+	return &redacted
 }
 
 // Node status
 type NodeStatus struct {
-	CPU    float64
-	Mem    float64
-	Disk   float64
-	Uptime int
+	CPU     float64
+	Mem     float64
+	Disk    float64
+	Uptime  int
+	CPUTemp float64 // Celsius, 0 if not reported
 }
 
 type NodeInfo struct {
@@ -33,13 +71,23 @@ type NodeInfo struct {
 	TransportProtocol string
 	FakeType          string
 	Host              string
+	Hosts             []string // Every host of a comma separated Host, e.g. for the http transport
 	Path              string
-	EnableTLS         bool
-	TLSType           string
+	EnableTLS         bool   // Deprecated: use TLSSettings.Enable
+	TLSType           string // Deprecated: use TLSSettings.Type
 	EnableVless       bool
 	CypherMethod      string
 	ServiceName       string
 	Header            json.RawMessage
+	TLSSettings       TLSSettings
+	parsedHeader      *parsedHeader // Memoized ParsedHeader of Header, set by FinishNodeInfo
+}
+
+// TLSSettings is the TLS config of a node
+type TLSSettings struct {
+	Enable     bool
+	Type       string // tls or xtls
+	ServerName string
 }
 
 type UserInfo struct {
@@ -79,7 +127,24 @@ type ClientInfo struct {
 
 type DetectRule struct {
 	ID      int
+	Type    RuleType // Empty for RuleTypeRegexp
 	Pattern string
+	Regexp  *regexp.Regexp `json:"-"` // Compiled regexp Pattern, nil if the rule was not compiled when loaded
+	IPNet   *net.IPNet     `json:"-"` // Parsed ip-cidr Pattern, nil if the rule was not parsed when loaded
+}
+
+// RuleProvider supplies the local rules merged with the panel rules by GetNodeRule,
+// they should have negative IDs, see IsLocalRule
+type RuleProvider interface {
+	LocalRules() []DetectRule
+}
+
+// StaticRules is a RuleProvider with a fixed rule list
+type StaticRules []DetectRule
+
+// LocalRules implements RuleProvider
+func (r StaticRules) LocalRules() []DetectRule {
+	return r
 }
 
 type DetectResult struct {
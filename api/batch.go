@@ -0,0 +1,37 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DefaultTrafficBatchSize is the number of users reported in one traffic request by default
+const DefaultTrafficBatchSize = 1000
+
+// ReportInBatches reports the traffic with report in batches of size, so a large node does not exceed
+// the panel body size limit. A failed batch does not stop the others, the returned error lists every failed batch.
+// Once ctx is done the remaining batches are skipped and ctx.Err() is returned.
+func ReportInBatches(ctx context.Context, userTraffic []UserTraffic, size int, report func(ctx context.Context, batch []UserTraffic) error) error {
+	if size <= 0 {
+		size = DefaultTrafficBatchSize
+	}
+	total := (len(userTraffic) + size - 1) / size
+	var failed []string
+	for i := 0; i < total; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := (i + 1) * size
+		if end > len(userTraffic) {
+			end = len(userTraffic)
+		}
+		if err := report(ctx, userTraffic[i*size:end]); err != nil {
+			failed = append(failed, fmt.Sprintf("batch %d/%d: %s", i+1, total, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("report user traffic failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestReportInBatches(t *testing.T) {
+	userTraffic := make([]api.UserTraffic, 2500)
+	for i := range userTraffic {
+		userTraffic[i] = api.UserTraffic{UID: i + 1, Upload: 100, Download: 200}
+	}
+	var batches []int
+	err := api.ReportInBatches(context.Background(), userTraffic, 0, func(ctx context.Context, batch []api.UserTraffic) error {
+		batches = append(batches, len(batch))
+		if len(batches) == 2 {
+			return errors.New("413 Request Entity Too Large")
+		}
+		return nil
+	})
+	if !reflect.DeepEqual(batches, []int{1000, 1000, 500}) {
+		t.Errorf("expected 3 reports of 1000, 1000 and 500 users, got %v", batches)
+	}
+	if err == nil || !strings.Contains(err.Error(), "batch 2/3") || strings.Contains(err.Error(), "batch 3/3") {
+		t.Errorf("expected only the second batch to be reported as failed, got %v", err)
+	}
+}
+
+func TestReportInBatchesCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var reports int
+	err := api.ReportInBatches(ctx, make([]api.UserTraffic, 30), 10, func(ctx context.Context, batch []api.UserTraffic) error {
+		reports++
+		cancel()
+		return nil
+	})
+	if reports != 1 || err != context.Canceled {
+		t.Errorf("expected the remaining batches to be skipped, got %d reports, %v", reports, err)
+	}
+}
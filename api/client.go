@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/XrayR-project/XrayR/common/serverstatus"
+	"github.com/go-resty/resty/v2"
+)
+
+// DefaultTimeout is the request timeout when neither Config.Timeout nor Config.HTTPClient is set
+const DefaultTimeout = 5 * time.Second
+
+// NewRestyClient creates the resty client of a panel client from its config: retries, redirects, timeout,
+// transport, certificate pinning and a unix socket ApiHost. The authentication is left to the caller.
+// It also returns the normalized ApiHost, to describe the client and build the error URLs.
+func NewRestyClient(apiConfig *Config) (*resty.Client, string, error) {
+	var client *resty.Client
+	if apiConfig.HTTPClient != nil {
+		client = resty.NewWithClient(apiConfig.HTTPClient)
+	} else {
+		client = resty.New()
+	}
+	retryCount := DefaultRetryCount
+	if apiConfig.RetryCount > 0 {
+		retryCount = apiConfig.RetryCount
+	}
+	client.SetRetryCount(apiConfig.RetryPolicy.MaxRetryCount(retryCount))
+	if apiConfig.RetryWaitTime > 0 {
+		retryWaitTime := time.Duration(apiConfig.RetryWaitTime) * time.Millisecond
+		client.SetRetryWaitTime(retryWaitTime)
+		client.SetRetryMaxWaitTime(retryWaitTime << retryCount)
+	}
+	client.AddRetryCondition(apiConfig.RetryPolicy.Condition(retryCount))
+	client.SetRedirectPolicy(RedirectPolicy(apiConfig.MaxRedirects))
+	client.SetRetryAfter(HonorRetryAfter(time.Duration(apiConfig.RetryJitter) * time.Millisecond))
+	if apiConfig.Timeout > 0 {
+		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
+	} else if apiConfig.HTTPClient == nil {
+		client.SetTimeout(DefaultTimeout)
+	}
+	// Avoid flooding the log when the panel keeps failing
+	client.SetLogger(PanelErrorLogger)
+	client.OnError(func(req *resty.Request, err error) {
+		if v, ok := err.(*resty.ResponseError); ok {
+			// v.Response contains the last response from the server
+			// v.Err contains the original error
+			PanelErrorLogger.Print(v.Err)
+		}
+	})
+	if apiConfig.Transport != nil {
+		client.SetTransport(apiConfig.Transport)
+	}
+	if apiConfig.PinnedCertSHA256 != "" {
+		transport, err := PinnedTransport(client.GetClient().Transport, apiConfig.PinnedCertSHA256)
+		if err != nil {
+			return nil, "", err
+		}
+		client.SetTransport(transport)
+	}
+	apiHost, err := NormalizeAPIHost(apiConfig.APIHost)
+	if err != nil {
+		return nil, "", err
+	}
+	hostURL := apiHost
+	if socketPath, ok := UnixSocketPath(apiHost); ok {
+		transport, err := UnixSocketTransport(client.GetClient().Transport, socketPath)
+		if err != nil {
+			return nil, "", err
+		}
+		client.SetTransport(transport)
+		// The host is ignored when dialing the unix socket
+		hostURL = "http://unix"
+	}
+	client.SetHostURL(hostURL)
+	return client, apiHost, nil
+}
+
+// localRuleCache avoids reparsing the local rule list when several nodes share the file
+var localRuleCache LocalRuleCache
+
+// LocalRules returns the local rules of the config, from its RuleProvider or its RuleListPath.
+// A bad rule list file is logged and never stops the node. Call it for every rule fetch to pick up
+// the edits of the file, it is only read again when its mtime changes.
+func LocalRules(apiConfig *Config) []DetectRule {
+	if apiConfig.RuleProvider != nil {
+		return apiConfig.RuleProvider.LocalRules()
+	}
+	return localRuleCache.Load(apiConfig.RuleListPath, func(path string) []DetectRule {
+		ruleList, err := ReadLocalRuleList(path)
+		if err != nil {
+			log.Print(err)
+		}
+		return ruleList
+	})
+}
+
+// DefaultTransportOf returns the transport protocol of a node whose panel provides none, tcp if not configured
+func DefaultTransportOf(apiConfig *Config) string {
+	if apiConfig.DefaultTransport != "" {
+		return apiConfig.DefaultTransport
+	}
+	return "tcp"
+}
+
+// ExportConfig returns the effective api config of a client as JSON with the secrets redacted
+func ExportConfig(apiConfig *Config, client *resty.Client) ([]byte, error) {
+	config := apiConfig.Redacted()
+	config.Timeout = int(client.GetClient().Timeout / time.Second)
+	config.DefaultTransport = DefaultTransportOf(apiConfig)
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// WarmUp resolves the panel host and opens a connection before the first request
+func WarmUp(ctx context.Context, client *resty.Client, apiHost string) error {
+	if err := ResolveHost(ctx, apiHost); err != nil {
+		return err
+	}
+	// Whatever the status, the connection is kept alive for the next request
+	if _, err := client.R().SetContext(ctx).Head("/"); err != nil {
+		return fmt.Errorf("connect %s failed: %s", apiHost, err)
+	}
+	return nil
+}
+
+// CPUTemp returns the CPU temperature to report, 0 if disabled or the sensor is missing
+func CPUTemp(apiConfig *Config, nodeStatus *NodeStatus) float64 {
+	if nodeStatus.CPUTemp != 0 || !apiConfig.ReportTemperature {
+		return nodeStatus.CPUTemp
+	}
+	temp, err := serverstatus.GetCPUTemp(apiConfig.TemperaturePath)
+	if err != nil {
+		// Many boxes have no thermal zone, just omit the temperature
+		return 0
+	}
+	return temp
+}
+
+// FinishNodeInfo applies the fixes shared by every panel to a parsed node info
+func FinishNodeInfo(nodeInfo *NodeInfo, defaultTransport string) {
+	// Some panels omit the transport protocol, which breaks the inbound config
+	if nodeInfo.TransportProtocol == "" {
+		log.Printf("Node %d has no transport protocol, use %s instead", nodeInfo.NodeID, defaultTransport)
+		nodeInfo.TransportProtocol = defaultTransport
+	}
+	nodeInfo.NormalizeHost()
+	nodeInfo.SyncTLSSettings()
+	// Memoize the header now, before the node info is shared
+	nodeInfo.ParsedHeader()
+}
+
+// EmptyUserListConfirmations is how many empty user lists in a row a guard rejects before it believes them,
+// so a panel that really removed all the users of a node is eventually applied
+const EmptyUserListConfirmations = 3
+
+// UserListGuard checks the user lists returned by a panel before they are applied
+type UserListGuard struct {
+	RejectEmpty   bool // Return ErrSuspiciousEmptyList for an empty list right after a non-empty one
+	lastUserCount int
+	emptyLists    int
+}
+
+// Check removes the users with a duplicated UID or UUID, and rejects a suspicious empty list
+func (g *UserListGuard) Check(userList *[]UserInfo) error {
+	if removed := DedupUserList(userList); removed > 0 {
+		log.Printf("Removed %d users with duplicated UID or UUID", removed)
+	}
+	// An empty list right after a non-empty one is more likely a panel glitch, unless the panel insists
+	if g.RejectEmpty && len(*userList) == 0 && g.lastUserCount > 0 {
+		if g.emptyLists++; g.emptyLists < EmptyUserListConfirmations {
+			return ErrSuspiciousEmptyList
+		}
+	}
+	g.emptyLists = 0
+	g.lastUserCount = len(*userList)
+	return nil
+}
@@ -0,0 +1,89 @@
+package api_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestUserListGuard(t *testing.T) {
+	guard := api.UserListGuard{RejectEmpty: true}
+	empty := []api.UserInfo{}
+	if err := guard.Check(&empty); err != nil {
+		t.Errorf("expected the first empty list to pass, got %v", err)
+	}
+	userList := []api.UserInfo{{UID: 1, UUID: "a"}, {UID: 1, UUID: "a"}, {UID: 2, UUID: "b"}}
+	if err := guard.Check(&userList); err != nil || len(userList) != 2 {
+		t.Errorf("expected 2 users without error, got %d, %v", len(userList), err)
+	}
+	for i := 1; i < api.EmptyUserListConfirmations; i++ {
+		if err := guard.Check(&empty); err != api.ErrSuspiciousEmptyList {
+			t.Errorf("empty list %d: expected ErrSuspiciousEmptyList, got %v", i, err)
+		}
+	}
+	if err := guard.Check(&empty); err != nil {
+		t.Errorf("expected the empty list to be accepted once confirmed, got %v", err)
+	}
+	if err := guard.Check(&empty); err != nil {
+		t.Errorf("expected the empty lists that follow to be accepted, got %v", err)
+	}
+
+	// A single empty list in between does not count towards the confirmations
+	userList = []api.UserInfo{{UID: 1, UUID: "a"}}
+	guard.Check(&userList)
+	guard.Check(&empty)
+	guard.Check(&userList)
+	if err := guard.Check(&empty); err != api.ErrSuspiciousEmptyList {
+		t.Errorf("expected the confirmations to restart, got %v", err)
+	}
+}
+
+func TestFinishNodeInfo(t *testing.T) {
+	nodeInfo := &api.NodeInfo{NodeID: 1}
+	api.FinishNodeInfo(nodeInfo, api.DefaultTransportOf(&api.Config{}))
+	if nodeInfo.TransportProtocol != "tcp" {
+		t.Errorf("expected tcp, got %q", nodeInfo.TransportProtocol)
+	}
+	nodeInfo = &api.NodeInfo{NodeID: 1, TransportProtocol: "ws"}
+	api.FinishNodeInfo(nodeInfo, "grpc")
+	if nodeInfo.TransportProtocol != "ws" {
+		t.Errorf("expected ws to be kept, got %q", nodeInfo.TransportProtocol)
+	}
+}
+
+func TestPanelErrorLogger(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	// Every request fails with connection refused
+	server.Close()
+	client, _, err := api.NewRestyClient(&api.Config{APIHost: server.URL, RetryCount: 1, RetryWaitTime: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.PanelErrorLogger.Flush()
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	client.R().Get("/mod_mu/users")
+	lines := strings.Count(buf.String(), "\n")
+	if lines == 0 {
+		t.Fatal("expected the failed request to be logged")
+	}
+	for i := 0; i < 9; i++ {
+		client.R().Get("/mod_mu/users")
+	}
+	if got := strings.Count(buf.String(), "\n"); got != lines {
+		t.Errorf("expected the failed polls to log %d lines, got %d: %s", lines, got, buf)
+	}
+	buf.Reset()
+	api.PanelErrorLogger.Flush()
+	if got := strings.Count(buf.String(), "(suppressed 9 identical messages)"); got != lines {
+		t.Errorf("expected Flush to report the %d suppressed messages, got %s", lines, buf)
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// ClientBase holds the state shared by every panel client and implements its panel independent methods,
+// the panel clients embed it. They implement Ping and SelfTest, which depend on their endpoints:
+// Ping validates the key and the node without touching the cached node info or the events, and
+// SelfTest probes every endpoint the client uses, the reports by HEAD so nothing is posted.
+type ClientBase struct {
+	Config    Config // Copy of the config the client was created with
+	Metrics   ResponseMetrics
+	RuleCache NodeRuleCache
+	Emitter   EventEmitter
+	client    *resty.Client
+	apiHost   string
+}
+
+// NewClientBase creates the ClientBase of a panel client, client and apiHost are returned by NewRestyClient
+func NewClientBase(apiConfig *Config, client *resty.Client, apiHost string) *ClientBase {
+	return &ClientBase{
+		Config:    *apiConfig,
+		RuleCache: NodeRuleCache{TTL: NodeRuleCacheTTL(apiConfig.RuleCacheTTL)},
+		client:    client,
+		apiHost:   apiHost,
+	}
+}
+
+// ExportConfig returns the effective api config as JSON with the secrets redacted
+func (b *ClientBase) ExportConfig() ([]byte, error) {
+	return ExportConfig(&b.Config, b.client)
+}
+
+// Events returns the channel of the poll, node change and rule hit events of the client
+func (b *ClientBase) Events() <-chan Event {
+	return b.Emitter.Events()
+}
+
+// WarmUp resolves the panel host and opens a connection before the first request
+func (b *ClientBase) WarmUp(ctx context.Context) error {
+	return WarmUp(ctx, b.client, b.apiHost)
+}
+
+// ResponseMetrics returns the size of the latest node_info and user_list responses
+func (b *ClientBase) ResponseMetrics() map[string]ResponseMetric {
+	return b.Metrics.Snapshot()
+}
+
+// InvalidateNodeRule drops the cached rule list, so the next GetNodeRule fetches it from the panel
+func (b *ClientBase) InvalidateNodeRule() {
+	b.RuleCache.Invalidate()
+}
@@ -0,0 +1,18 @@
+package api
+
+// IsLocalRule reports whether a rule ID belongs to a local rule. Local rules get negative IDs so they
+// never collide with the panel rules, and they have no panel ID to report.
+func IsLocalRule(ruleID int) bool {
+	return ruleID < 0
+}
+
+// PanelDetectResults returns the detect results of the panel rules, the only ones the panel knows
+func PanelDetectResults(detectResultList []DetectResult) []DetectResult {
+	panelResults := make([]DetectResult, 0, len(detectResultList))
+	for _, r := range detectResultList {
+		if !IsLocalRule(r.RuleID) {
+			panelResults = append(panelResults, r)
+		}
+	}
+	return panelResults
+}
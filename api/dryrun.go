@@ -0,0 +1,16 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// LogDryRun logs the payload a report would post to path when DryRun is enabled
+func LogDryRun(path string, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Dry run, not posting to %s: %v", path, payload)
+		return
+	}
+	log.Printf("Dry run, not posting to %s: %s", path, body)
+}
@@ -0,0 +1,22 @@
+package api_test
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestLogDryRun(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	api.LogDryRun("/mod_mu/users/traffic", []api.UserTraffic{{UID: 1, Upload: 100, Download: 200}})
+	if payload := `Dry run, not posting to /mod_mu/users/traffic: [{"UID":1,"Email":"","Upload":100,"Download":200}]`; !strings.Contains(logs.String(), payload) {
+		t.Errorf("payload %s not logged in:\n%s", payload, logs.String())
+	}
+}
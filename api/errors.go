@@ -0,0 +1,83 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// ErrorKind tells why a panel request failed
+type ErrorKind int
+
+const (
+	NetworkError   ErrorKind = iota + 1 // The request did not get a response
+	HTTPError                           // The panel answered with an HTTP error status
+	ParseError                          // The response body is not what the client expects
+	PanelError                          // The panel rejected the request in its response
+	RateLimitError                      // The panel answered 429 Too Many Requests, see APIError.RetryAfter
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case NetworkError:
+		return "network error"
+	case HTTPError:
+		return "http error"
+	case ParseError:
+		return "parse error"
+	case PanelError:
+		return "panel error"
+	case RateLimitError:
+		return "rate limit error"
+	default:
+		return "unknown error"
+	}
+}
+
+// APIError is returned by the panel clients when a request fails, use errors.As to inspect it
+type APIError struct {
+	Kind       ErrorKind
+	URL        string
+	StatusCode int           // HTTP status, 0 for a network error
+	Message    string        // Response body for a HTTPError, panel response for a PanelError
+	Err        error         // Underlying error, if any
+	RetryAfter time.Duration // Wait suggested by the Retry-After header of a RateLimitError, 0 if absent
+}
+
+func (e *APIError) Error() string {
+	switch e.Kind {
+	case HTTPError:
+		return fmt.Sprintf("request %s failed: %s", e.URL, e.Message)
+	case PanelError:
+		return fmt.Sprintf("Ret %s invalid", e.Message)
+	case RateLimitError:
+		return fmt.Sprintf("request %s rate limited, retry after %s", e.URL, e.RetryAfter)
+	default:
+		return fmt.Sprintf("request %s failed: %s", e.URL, e.Err)
+	}
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// NewRequestError classifies an error returned by resty: once the panel has answered,
+// the error comes from decoding the response rather than from the network.
+func NewRequestError(url string, statusCode int, err error) *APIError {
+	kind := NetworkError
+	if statusCode != 0 {
+		kind = ParseError
+	}
+	return &APIError{Kind: kind, URL: url, StatusCode: statusCode, Err: err}
+}
+
+// NewRateLimitError returns a RateLimitError carrying the Retry-After of a 429 response, nil for any other response
+func NewRateLimitError(url string, res *resty.Response) *APIError {
+	if res == nil || res.StatusCode() != http.StatusTooManyRequests {
+		return nil
+	}
+	retryAfter, _ := ParseRetryAfter(res.Header().Get("Retry-After"), time.Now())
+	return &APIError{Kind: RateLimitError, URL: url, StatusCode: res.StatusCode(), Message: string(res.Body()), RetryAfter: retryAfter}
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// NodeInfoCache remembers the last node info and its ETag, so an unchanged node info is not downloaded again
+type NodeInfoCache struct {
+	mu       sync.RWMutex
+	etag     string
+	nodeInfo *NodeInfo
+}
+
+// SetIfNoneMatch adds the If-None-Match header for the cached node info to req
+func (c *NodeInfoCache) SetIfNoneMatch(req *resty.Request) *resty.Request {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.etag != "" && c.nodeInfo != nil {
+		req.SetHeader("If-None-Match", c.etag)
+	}
+	return req
+}
+
+// NotModified returns a copy of the cached node info if the panel answered 304 Not Modified
+func (c *NodeInfoCache) NotModified(res *resty.Response) (*NodeInfo, bool) {
+	if res == nil || res.StatusCode() != http.StatusNotModified {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.nodeInfo == nil {
+		return nil, false
+	}
+	nodeInfo := *c.nodeInfo
+	return &nodeInfo, true
+}
+
+// Store caches nodeInfo with the ETag of the response it was parsed from, res is nil if it has no response of its own
+func (c *NodeInfoCache) Store(res *resty.Response, nodeInfo *NodeInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.etag = ""
+	if res != nil {
+		c.etag = res.Header().Get("ETag")
+	}
+	cached := *nodeInfo
+	c.nodeInfo = &cached
+}
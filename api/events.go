@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// DefaultEventBuffer is the number of events kept for a slow subscriber before new ones are dropped
+const DefaultEventBuffer = 100
+
+// EventType tells what happened in a panel client
+type EventType int
+
+const (
+	PollSucceeded EventType = iota + 1 // A node_info, user_list or node_rule request succeeded
+	PollFailed                         // A node_info, user_list or node_rule request failed
+	NodeChanged                        // The panel returned a different node info
+	RuleHit                            // A user hit an audit rule
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PollSucceeded:
+		return "poll succeeded"
+	case PollFailed:
+		return "poll failed"
+	case NodeChanged:
+		return "node changed"
+	case RuleHit:
+		return "rule hit"
+	default:
+		return "unknown event"
+	}
+}
+
+// Event is emitted by a panel client to the Events channel
+type Event struct {
+	Type         EventType
+	Time         time.Time
+	Endpoint     string       // PollSucceeded and PollFailed only
+	Err          error        // PollFailed only
+	NodeInfo     *NodeInfo    // NodeChanged only
+	DetectResult DetectResult // RuleHit only
+}
+
+// EventEmitter sends the events of a panel client to its subscriber without ever blocking the client.
+// Nothing is buffered before Events is called, and events are dropped while the buffer is full.
+type EventEmitter struct {
+	mu           sync.Mutex
+	ch           chan Event
+	lastNodeInfo *NodeInfo
+}
+
+// Events returns the channel of the emitted events
+func (e *EventEmitter) Events() <-chan Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ch == nil {
+		e.ch = make(chan Event, DefaultEventBuffer)
+	}
+	return e.ch
+}
+
+func (e *EventEmitter) emit(event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ch == nil {
+		return
+	}
+	event.Time = time.Now()
+	select {
+	case e.ch <- event:
+	default:
+	}
+}
+
+// Poll emits the result of a poll, call it as defer e.Poll(endpoint, &err) to see the returned error
+func (e *EventEmitter) Poll(endpoint string, err *error) {
+	if *err != nil && !errors.Is(*err, ErrNodeInfoNotModified) {
+		e.emit(Event{Type: PollFailed, Endpoint: endpoint, Err: *err})
+		return
+	}
+	e.emit(Event{Type: PollSucceeded, Endpoint: endpoint})
+}
+
+// NodeInfo emits NodeChanged if nodeInfo differs from the previous one
+func (e *EventEmitter) NodeInfo(nodeInfo *NodeInfo) {
+	e.mu.Lock()
+	changed := e.lastNodeInfo != nil && !reflect.DeepEqual(e.lastNodeInfo, nodeInfo)
+	e.lastNodeInfo = nodeInfo
+	e.mu.Unlock()
+	if changed {
+		e.emit(Event{Type: NodeChanged, NodeInfo: nodeInfo})
+	}
+}
+
+// RuleHit emits a RuleHit for each detect result
+func (e *EventEmitter) RuleHit(detectResultList []DetectResult) {
+	for _, r := range detectResultList {
+		e.emit(Event{Type: RuleHit, DetectResult: r})
+	}
+}
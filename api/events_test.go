@@ -0,0 +1,37 @@
+package api_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestEventEmitter(t *testing.T) {
+	var e api.EventEmitter
+	err := errors.New("timeout")
+	// Nothing is kept before subscribing
+	e.Poll("node_info", &err)
+	events := e.Events()
+	if len(events) != 0 {
+		t.Fatalf("expected no event before subscribing, got %d", len(events))
+	}
+
+	e.NodeInfo(&api.NodeInfo{Port: 443})
+	e.NodeInfo(&api.NodeInfo{Port: 443})
+	e.NodeInfo(&api.NodeInfo{Port: 8443})
+	if event := <-events; event.Type != api.NodeChanged || event.NodeInfo.Port != 8443 {
+		t.Errorf("expected the port change, got %s %+v", event.Type, event.NodeInfo)
+	}
+
+	// A full buffer drops the new events instead of blocking
+	for i := 0; i < api.DefaultEventBuffer+1; i++ {
+		e.RuleHit([]api.DetectResult{{UID: i, RuleID: 1}})
+	}
+	if len(events) != api.DefaultEventBuffer {
+		t.Errorf("expected %d buffered events, got %d", api.DefaultEventBuffer, len(events))
+	}
+	if event := <-events; event.Type != api.RuleHit || event.DetectResult.UID != 0 {
+		t.Errorf("expected the first rule hit, got %s %+v", event.Type, event.DetectResult)
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// HTTPHeaderConfig is the parsed form of NodeInfo.Header
+type HTTPHeaderConfig struct {
+	Type     string              `json:"type"`
+	Request  *HTTPRequestConfig  `json:"request,omitempty"`
+	Response *HTTPResponseConfig `json:"response,omitempty"`
+}
+
+// HTTPRequestConfig is the request part of a http header config
+type HTTPRequestConfig struct {
+	Version string                `json:"version,omitempty"`
+	Method  string                `json:"method,omitempty"`
+	Path    StringList            `json:"path,omitempty"`
+	Headers map[string]StringList `json:"headers,omitempty"`
+}
+
+// HTTPResponseConfig is the response part of a http header config
+type HTTPResponseConfig struct {
+	Version string                `json:"version,omitempty"`
+	Status  string                `json:"status,omitempty"`
+	Reason  string                `json:"reason,omitempty"`
+	Headers map[string]StringList `json:"headers,omitempty"`
+}
+
+// StringList accepts both a single string and an array of strings, like the xray config does
+type StringList []string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = StringList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("unknown format of a string list: %s", string(data))
+	}
+	*l = list
+	return nil
+}
+
+type parsedHeader struct {
+	header *HTTPHeaderConfig
+	err    error
+}
+
+// ParsedHeader returns the typed form of Header, nil if the node has no header.
+// The result is memoized on the NodeInfo and shared by its copies, do not modify it.
+// FinishNodeInfo parses it before the node info leaves the panel client, so a node info from a client is
+// safe for concurrent use, and two node infos with the same Header stay equal under reflect.DeepEqual.
+func (n *NodeInfo) ParsedHeader() (*HTTPHeaderConfig, error) {
+	if len(n.Header) == 0 {
+		return nil, nil
+	}
+	if n.parsedHeader != nil {
+		return n.parsedHeader.header, n.parsedHeader.err
+	}
+	p := &parsedHeader{header: new(HTTPHeaderConfig)}
+	if err := json.Unmarshal(n.Header, p.header); err != nil {
+		p.header = nil
+		p.err = fmt.Errorf("Unmarshal header %s failed: %s", string(n.Header), err)
+	}
+	n.parsedHeader = p
+	return p.header, p.err
+}
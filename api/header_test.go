@@ -0,0 +1,87 @@
+package api_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestParsedHeader(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		Header: json.RawMessage(`{
+			"type": "http",
+			"request": {
+				"version": "1.1",
+				"method": "GET",
+				"path": ["/", "/index.html"],
+				"headers": {
+					"Host": ["www.baidu.com", "www.bing.com"],
+					"Connection": "keep-alive"
+				}
+			},
+			"response": {
+				"version": "1.1",
+				"status": "200",
+				"reason": "OK",
+				"headers": {
+					"Content-Type": ["application/octet-stream", "video/mpeg"]
+				}
+			}
+		}`),
+	}
+	header, err := nodeInfo.ParsedHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Type != "http" {
+		t.Errorf("header type = %s, want http", header.Type)
+	}
+	if header.Request == nil || len(header.Request.Path) != 2 || len(header.Request.Headers["Host"]) != 2 {
+		t.Errorf("unexpected request: %+v", header.Request)
+	}
+	if c := header.Request.Headers["Connection"]; len(c) != 1 || c[0] != "keep-alive" {
+		t.Errorf("single string header not parsed: %v", c)
+	}
+	if header.Response == nil || header.Response.Status != "200" {
+		t.Errorf("unexpected response: %+v", header.Response)
+	}
+
+	// The second call must return the memoized result
+	again, err := nodeInfo.ParsedHeader()
+	if err != nil || again != header {
+		t.Error("ParsedHeader is not memoized")
+	}
+}
+
+func TestParsedHeaderInvalid(t *testing.T) {
+	nodeInfo := &api.NodeInfo{Header: json.RawMessage(`{"type": 1}`)}
+	if _, err := nodeInfo.ParsedHeader(); err == nil {
+		t.Error("expected error for invalid header")
+	}
+	empty := &api.NodeInfo{}
+	if header, err := empty.ParsedHeader(); header != nil || err != nil {
+		t.Error("expected nil header for empty Header")
+	}
+}
+
+func TestParsedHeaderPerNode(t *testing.T) {
+	header := json.RawMessage(`{"type": "http", "request": {"path": "/"}}`)
+	a := &api.NodeInfo{NodeID: 1, TransportProtocol: "tcp", Header: header}
+	b := &api.NodeInfo{NodeID: 1, TransportProtocol: "tcp", Header: header}
+	api.FinishNodeInfo(a, "tcp")
+	api.FinishNodeInfo(b, "tcp")
+	if !reflect.DeepEqual(a, b) {
+		t.Error("expected node infos with the same header to stay equal")
+	}
+	parsedA, _ := a.ParsedHeader()
+	parsedB, _ := b.ParsedHeader()
+	if parsedA == parsedB {
+		t.Error("expected every node info to parse its own header")
+	}
+	parsedA.Request.Path[0] = "/changed"
+	if parsedB.Request.Path[0] != "/" {
+		t.Error("expected a change to one parsed header to leave the others alone")
+	}
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SplitHost splits a panel host like "example.com", "example.com:443", "[2001:db8::1]:443"
+// or a comma separated list of them into the hosts without their port, and the first port found.
+// IPv6 literals keep their brackets so they can be used in a Host header.
+func SplitHost(raw string) (hosts []string, port int) {
+	for _, h := range strings.Split(raw, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if host, p, err := net.SplitHostPort(h); err == nil {
+			if n, err := strconv.Atoi(p); err == nil && port == 0 {
+				port = n
+			}
+			h = host
+			if strings.Contains(h, ":") {
+				h = "[" + h + "]"
+			}
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, port
+}
+
+// NormalizeHost strips the port from Host and fills Hosts with every host of a comma separated list
+func (n *NodeInfo) NormalizeHost() {
+	hosts, _ := SplitHost(n.Host)
+	n.Hosts = hosts
+	if len(hosts) > 0 {
+		n.Host = hosts[0]
+	} else {
+		n.Host = ""
+	}
+}
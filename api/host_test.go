@@ -0,0 +1,40 @@
+package api_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestSplitHost(t *testing.T) {
+	cases := []struct {
+		raw   string
+		hosts []string
+		port  int
+	}{
+		{"example.com", []string{"example.com"}, 0},
+		{"example.com:443", []string{"example.com"}, 443},
+		{"a.example.com, b.example.com:8443,", []string{"a.example.com", "b.example.com"}, 8443},
+		{"[2001:db8::1]:443", []string{"[2001:db8::1]"}, 443},
+		{"[2001:db8::1]", []string{"[2001:db8::1]"}, 0},
+		{"", nil, 0},
+	}
+	for _, c := range cases {
+		hosts, port := api.SplitHost(c.raw)
+		if !reflect.DeepEqual(hosts, c.hosts) || port != c.port {
+			t.Errorf("SplitHost(%q) = %v, %d, want %v, %d", c.raw, hosts, port, c.hosts, c.port)
+		}
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	nodeInfo := &api.NodeInfo{Host: "a.example.com:443,b.example.com"}
+	nodeInfo.NormalizeHost()
+	if nodeInfo.Host != "a.example.com" {
+		t.Errorf("Host = %q, want a.example.com", nodeInfo.Host)
+	}
+	if !reflect.DeepEqual(nodeInfo.Hosts, []string{"a.example.com", "b.example.com"}) {
+		t.Errorf("Hosts = %v", nodeInfo.Hosts)
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultIllegalReportCooldown is how long a reported rule hit is not reported again when
+// Config.IllegalCooldown is not set
+const DefaultIllegalReportCooldown = 60 * time.Second
+
+// IllegalReportCooldown returns the cooldown of an IllegalCooldown in sec, 0 for
+// DefaultIllegalReportCooldown and negative for disable
+func IllegalReportCooldown(sec int) time.Duration {
+	if sec == 0 {
+		return DefaultIllegalReportCooldown
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// IllegalReportDedup collapses the same (UID, RuleID) hit reported again within Cooldown,
+// so a user hitting a blocked site repeatedly does not flood the panel
+type IllegalReportDedup struct {
+	Cooldown time.Duration // 0 for disable
+	mu       sync.Mutex
+	reported map[DetectResult]time.Time
+}
+
+// Filter returns the detect results not reported within the cooldown, without duplicates.
+// Call Reported with them once the panel accepted them, so a failed report is retried.
+func (d *IllegalReportDedup) Filter(detectResultList []DetectResult) []DetectResult {
+	if d.Cooldown <= 0 {
+		return detectResultList
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	// Prune the expired entries so the map only holds the hits of the last cooldown
+	for r, at := range d.reported {
+		if now.Sub(at) >= d.Cooldown {
+			delete(d.reported, r)
+		}
+	}
+	fresh := make([]DetectResult, 0, len(detectResultList))
+	seen := make(map[DetectResult]bool, len(detectResultList))
+	for _, r := range detectResultList {
+		if _, ok := d.reported[r]; ok || seen[r] {
+			continue
+		}
+		seen[r] = true
+		fresh = append(fresh, r)
+	}
+	return fresh
+}
+
+// Reported starts the cooldown of the reported detect results
+func (d *IllegalReportDedup) Reported(detectResultList ...DetectResult) {
+	if d.Cooldown <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.reported == nil {
+		d.reported = make(map[DetectResult]time.Time)
+	}
+	now := time.Now()
+	for _, r := range detectResultList {
+		d.reported[r] = now
+	}
+}
+
+// Len returns the number of detect results in their cooldown
+func (d *IllegalReportDedup) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.reported)
+}
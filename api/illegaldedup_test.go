@@ -0,0 +1,44 @@
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestIllegalReportDedup(t *testing.T) {
+	d := api.IllegalReportDedup{Cooldown: 50 * time.Millisecond}
+	hit := api.DetectResult{UID: 1, RuleID: 2}
+	if fresh := d.Filter([]api.DetectResult{hit, hit}); len(fresh) != 1 {
+		t.Fatalf("expected the duplicate hit to be collapsed, got %v", fresh)
+	}
+	// Not reported yet, e.g. the panel was down
+	if fresh := d.Filter([]api.DetectResult{hit}); len(fresh) != 1 {
+		t.Fatalf("expected an unreported hit to be kept, got %v", fresh)
+	}
+	d.Reported(hit)
+	if fresh := d.Filter([]api.DetectResult{hit, {UID: 1, RuleID: 3}}); len(fresh) != 1 || fresh[0].RuleID != 3 {
+		t.Errorf("expected only the new rule hit within the cooldown, got %v", fresh)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if fresh := d.Filter(nil); len(fresh) != 0 || d.Len() != 0 {
+		t.Errorf("expected the expired hit to be pruned, %d left", d.Len())
+	}
+	if fresh := d.Filter([]api.DetectResult{hit}); len(fresh) != 1 {
+		t.Errorf("expected the hit to be reported again after the cooldown, got %v", fresh)
+	}
+}
+
+func TestIllegalReportCooldown(t *testing.T) {
+	if d := api.IllegalReportCooldown(0); d != api.DefaultIllegalReportCooldown {
+		t.Errorf("got %s for 0, want the default", d)
+	}
+	d := api.IllegalReportDedup{Cooldown: api.IllegalReportCooldown(-1)}
+	hit := api.DetectResult{UID: 1, RuleID: 2}
+	d.Reported(hit)
+	if fresh := d.Filter([]api.DetectResult{hit}); len(fresh) != 1 {
+		t.Errorf("expected a disabled dedup to keep every hit, got %v", fresh)
+	}
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// IPHasher replaces the reported IPs with a keyed hash, so the panel can still count the distinct IPs
+// of a user without learning them. The panel counts the IPs of a user across all its nodes, so every
+// node must hash with the same salt, and the salt must survive restarts, see Config.HashSalt.
+type IPHasher struct {
+	salt []byte
+}
+
+// NewIPHasher returns the IPHasher of the config, nil if HashReportedIPs is off.
+// The HashSalt is required and must be kept from the panel: the IPv4 space is small enough
+// to hash every address, so a salt the panel knows, like the ApiKey, would hide nothing.
+func NewIPHasher(apiConfig *Config) (*IPHasher, error) {
+	if !apiConfig.HashReportedIPs {
+		return nil, nil
+	}
+	if apiConfig.HashSalt == "" {
+		return nil, fmt.Errorf("HashReportedIPs requires a secret HashSalt")
+	}
+	return &IPHasher{salt: []byte(apiConfig.HashSalt)}, nil
+}
+
+// Hash returns the hash of ip to report, or ip itself on a nil IPHasher
+func (h *IPHasher) Hash(ip string) string {
+	if h == nil {
+		return ip
+	}
+	mac := hmac.New(sha256.New, h.salt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,31 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestIPHasherStableSalt(t *testing.T) {
+	if h, err := api.NewIPHasher(&api.Config{Key: "123"}); h != nil || err != nil {
+		t.Fatalf("expected no hasher with HashReportedIPs off, got %v, %v", h, err)
+	}
+	// The panel knows the ApiKey, it cannot stand in for the salt
+	if _, err := api.NewIPHasher(&api.Config{Key: "123", HashReportedIPs: true}); err == nil {
+		t.Fatal("expected HashReportedIPs to require a HashSalt")
+	}
+	node := func(key, salt string) string {
+		h, err := api.NewIPHasher(&api.Config{Key: key, HashSalt: salt, HashReportedIPs: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.Hash("1.1.1.1")
+	}
+	// Another node of the panel, or the same node after a restart
+	if node("123", "secret") != node("456", "secret") {
+		t.Error("expected the same hash from the same HashSalt")
+	}
+	if node("123", "secret") == node("123", "other") {
+		t.Error("expected the HashSalt to key the hash")
+	}
+}
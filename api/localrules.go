@@ -0,0 +1,46 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// ReadLocalRuleList reads one rule pattern per line of the file at path, an empty path gives no rules.
+// Blank lines and lines starting with # are skipped, so the file can be annotated.
+// A line may start with a type prefix, e.g. "domain:example.com" or "ip-cidr:10.0.0.0/8", see SplitRuleType.
+// Each pattern is compiled once here, an invalid one is logged with its line number and skipped.
+// A read error stops reading, the rules read so far are returned with the error.
+func ReadLocalRuleList(path string) ([]DetectRule, error) {
+	ruleList := make([]DetectRule, 0)
+	if path == "" {
+		return ruleList, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return ruleList, fmt.Errorf("Error when opening file: %s", err)
+	}
+	defer file.Close()
+
+	fileScanner := bufio.NewScanner(file)
+	for line := 1; fileScanner.Scan(); line++ {
+		pattern := strings.TrimSpace(fileScanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		ruleType, pattern := SplitRuleType(pattern)
+		// Count down from -1, the panel rules keep their own IDs
+		rule, err := NewDetectRule(-len(ruleList)-1, ruleType, pattern)
+		if err != nil {
+			log.Printf("Skip the invalid rule at %s:%d: %s", path, line, err)
+			continue
+		}
+		ruleList = append(ruleList, rule)
+	}
+	if err := fileScanner.Err(); err != nil {
+		return ruleList, fmt.Errorf("Error while reading file %s after %d rules: %s", path, len(ruleList), err)
+	}
+	return ruleList, nil
+}
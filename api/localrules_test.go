@@ -0,0 +1,73 @@
+package api_test
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestReadLocalRuleListScanError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rulelist")
+	// A line longer than the scanner buffer fails the read
+	content := "baidu.com\n" + strings.Repeat("a", bufio.MaxScanTokenSize+1) + "\ngoogle.com\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ruleList, err := api.ReadLocalRuleList(path)
+	if err == nil {
+		t.Error("expected the read error to be returned")
+	}
+	if len(ruleList) != 1 || ruleList[0].Pattern != "baidu.com" {
+		t.Errorf("expected the rules before the bad line, got %+v", ruleList)
+	}
+}
+
+func TestReadLocalRuleListMissingFile(t *testing.T) {
+	ruleList, err := api.ReadLocalRuleList(filepath.Join(t.TempDir(), "missing"))
+	if err == nil || len(ruleList) != 0 {
+		t.Errorf("expected an error and no rules, got %+v, %v", ruleList, err)
+	}
+}
+
+func TestReadLocalRuleListInvalidRegex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rulelist")
+	if err := os.WriteFile(path, []byte("(.*\\.)?baidu\\.com\n(unclosed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ruleList, err := api.ReadLocalRuleList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ruleList) != 1 || ruleList[0].Pattern != `(.*\.)?baidu\.com` {
+		t.Fatalf("expected only the valid rule, got %+v", ruleList)
+	}
+	if ruleList[0].Regexp == nil || !ruleList[0].Regexp.MatchString("www.baidu.com") {
+		t.Errorf("expected the rule to be compiled, got %v", ruleList[0].Regexp)
+	}
+}
+
+func TestReadLocalRuleListComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rulelist")
+	content := "# Search engines\nbaidu.com\n\n   \n  # Video\nyoutube.com\n  bilibili.com  \n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ruleList, err := api.ReadLocalRuleList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patterns []string
+	for i, r := range ruleList {
+		patterns = append(patterns, r.Pattern)
+		if r.ID != -i-1 {
+			t.Errorf("rule %s: got ID %d, want %d", r.Pattern, r.ID, -i-1)
+		}
+	}
+	if strings.Join(patterns, ",") != "baidu.com,youtube.com,bilibili.com" {
+		t.Errorf("unexpected rules: %v", patterns)
+	}
+}
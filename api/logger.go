@@ -0,0 +1,111 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// RateLimitedLogger logs an identical message at most once per interval,
+// and reports how many copies were suppressed in between.
+type RateLimitedLogger struct {
+	interval time.Duration
+	logger   *log.Logger
+	entries  map[string]*logEntry
+	access   sync.Mutex
+}
+
+type logEntry struct {
+	last       time.Time
+	suppressed int
+}
+
+// NewRateLimitedLogger creates a RateLimitedLogger, logger defaults to the standard logger
+func NewRateLimitedLogger(interval time.Duration, logger *log.Logger) *RateLimitedLogger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &RateLimitedLogger{
+		interval: interval,
+		logger:   logger,
+		entries:  make(map[string]*logEntry),
+	}
+}
+
+// PanelErrorLogger rate limits the panel errors logged by the api clients, resty included, and the controllers
+var PanelErrorLogger = NewRateLimitedLogger(time.Minute, nil)
+
+// Print logs the message in the manner of fmt.Sprint unless it was logged within the interval
+func (l *RateLimitedLogger) Print(v ...interface{}) {
+	l.print(fmt.Sprint(v...))
+}
+
+// Errorf implements resty.Logger
+func (l *RateLimitedLogger) Errorf(format string, v ...interface{}) {
+	l.print("ERROR RESTY " + fmt.Sprintf(format, v...))
+}
+
+// Warnf implements resty.Logger
+func (l *RateLimitedLogger) Warnf(format string, v ...interface{}) {
+	l.print("WARN RESTY " + fmt.Sprintf(format, v...))
+}
+
+// Debugf implements resty.Logger, the debug logs are never suppressed
+func (l *RateLimitedLogger) Debugf(format string, v ...interface{}) {
+	l.logger.Output(2, "DEBUG RESTY "+fmt.Sprintf(format, v...))
+}
+
+// Flush logs how many copies of each message were suppressed since it was last logged, call it before exiting
+func (l *RateLimitedLogger) Flush() {
+	l.access.Lock()
+	var outputs []string
+	for m, e := range l.entries {
+		if e.suppressed > 0 {
+			outputs = append(outputs, suppressedOutput(m, e.suppressed))
+		}
+	}
+	l.entries = make(map[string]*logEntry)
+	l.access.Unlock()
+
+	for _, output := range outputs {
+		l.logger.Output(2, output)
+	}
+}
+
+func (l *RateLimitedLogger) print(msg string) {
+	now := time.Now()
+
+	l.access.Lock()
+	// Drop the expired entries so the map does not grow unbounded,
+	// and report their suppressed copies so the end of a burst is not lost
+	var outputs []string
+	for m, e := range l.entries {
+		if m != msg && now.Sub(e.last) >= l.interval {
+			if e.suppressed > 0 {
+				outputs = append(outputs, suppressedOutput(m, e.suppressed))
+			}
+			delete(l.entries, m)
+		}
+	}
+	entry, ok := l.entries[msg]
+	if ok && now.Sub(entry.last) < l.interval {
+		entry.suppressed++
+	} else {
+		if ok && entry.suppressed > 0 {
+			outputs = append(outputs, suppressedOutput(msg, entry.suppressed))
+		} else {
+			outputs = append(outputs, msg)
+		}
+		l.entries[msg] = &logEntry{last: now}
+	}
+	l.access.Unlock()
+
+	for _, output := range outputs {
+		l.logger.Output(3, output)
+	}
+}
+
+func suppressedOutput(msg string, suppressed int) string {
+	return fmt.Sprintf("%s (suppressed %d identical messages)", msg, suppressed)
+}
@@ -0,0 +1,55 @@
+package api_test
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestRateLimitedLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := api.NewRateLimitedLogger(100*time.Millisecond, log.New(buf, "", 0))
+
+	for i := 0; i < 5; i++ {
+		logger.Print("request /mod_mu/users failed")
+	}
+	logger.Print("another error")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %q", len(lines), lines)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	buf.Reset()
+	logger.Print("request /mod_mu/users failed")
+	if got := strings.TrimSpace(buf.String()); got != "request /mod_mu/users failed (suppressed 4 identical messages)" {
+		t.Errorf("unexpected output after interval: %q", got)
+	}
+}
+
+func TestRateLimitedLoggerFlush(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := api.NewRateLimitedLogger(100*time.Millisecond, log.New(buf, "", 0))
+
+	for i := 0; i < 3; i++ {
+		logger.Print("request /mod_mu/users failed")
+	}
+	// The panel recovered, another message reports the end of the burst
+	time.Sleep(150 * time.Millisecond)
+	buf.Reset()
+	logger.Print("another error")
+	if got := buf.String(); got != "request /mod_mu/users failed (suppressed 2 identical messages)\nanother error\n" {
+		t.Errorf("unexpected output after interval: %q", got)
+	}
+
+	buf.Reset()
+	logger.Print("another error")
+	logger.Flush()
+	if got := buf.String(); got != "another error (suppressed 1 identical messages)\n" {
+		t.Errorf("unexpected output of Flush: %q", got)
+	}
+}
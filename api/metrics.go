@@ -0,0 +1,50 @@
+package api
+
+import (
+	"log"
+	"sync"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// ResponseMetric is the size of a panel response
+type ResponseMetric struct {
+	Bytes int
+	Users int // Only set for the user list
+}
+
+// ResponseMetrics records the size of the latest panel response of each endpoint
+type ResponseMetrics struct {
+	metrics sync.Map // Key: endpoint, Value: ResponseMetric
+}
+
+// Record stores the size of the latest response of the endpoint
+func (m *ResponseMetrics) Record(endpoint string, bytes int, users int) {
+	m.metrics.Store(endpoint, ResponseMetric{Bytes: bytes, Users: users})
+}
+
+// RecordResponse stores the size of the latest response of the endpoint, and logs it in debug mode
+func (m *ResponseMetrics) RecordResponse(client *resty.Client, endpoint string, res *resty.Response) {
+	m.Record(endpoint, len(res.Body()), 0)
+	if client.Debug {
+		log.Printf("%s response: %d bytes", endpoint, len(res.Body()))
+	}
+}
+
+// RecordUserList stores the size and the user count of the latest user_list response, and logs them in debug mode
+func (m *ResponseMetrics) RecordUserList(client *resty.Client, res *resty.Response, users int) {
+	m.Record("user_list", len(res.Body()), users)
+	if client.Debug {
+		log.Printf("user_list response: %d bytes, %d users", len(res.Body()), users)
+	}
+}
+
+// Snapshot returns the recorded metrics
+func (m *ResponseMetrics) Snapshot() map[string]ResponseMetric {
+	snapshot := make(map[string]ResponseMetric)
+	m.metrics.Range(func(key, value interface{}) bool {
+		snapshot[key.(string)] = value.(ResponseMetric)
+		return true
+	})
+	return snapshot
+}
@@ -0,0 +1,46 @@
+package api_test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/go-resty/resty/v2"
+)
+
+func TestResponseMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ret":1,"data":[]}`)
+	}))
+	defer server.Close()
+	client := resty.New().SetHostURL(server.URL)
+	res, err := client.R().Get("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Debug = true
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	var metrics api.ResponseMetrics
+	metrics.RecordResponse(client, "node_info", res)
+	metrics.RecordUserList(client, res, 3)
+	snapshot := metrics.Snapshot()
+	if m := snapshot["node_info"]; m.Bytes != 19 || m.Users != 0 {
+		t.Errorf("node_info metric = %+v, want 19 bytes and no users", m)
+	}
+	if m := snapshot["user_list"]; m.Bytes != 19 || m.Users != 3 {
+		t.Errorf("user_list metric = %+v, want 19 bytes and 3 users", m)
+	}
+	if !strings.Contains(logs.String(), "node_info response: 19 bytes\n") || strings.Count(logs.String(), "users") != 1 {
+		t.Errorf("expected only the user list to log a user count, got:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// FlexibleInt is an int the panel may encode either as a JSON number or as a numeric string like "200"
+type FlexibleInt int
+
+// UnmarshalJSON implements json.Unmarshaler
+func (i *FlexibleInt) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		data = []byte(s)
+	}
+	n, err := strconv.Atoi(string(data))
+	if err != nil {
+		return fmt.Errorf("%s is not an integer", string(data))
+	}
+	*i = FlexibleInt(n)
+	return nil
+}
@@ -0,0 +1,23 @@
+package api_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestFlexibleInt(t *testing.T) {
+	for _, data := range []string{`200`, `"200"`} {
+		var code api.FlexibleInt
+		if err := json.Unmarshal([]byte(data), &code); err != nil {
+			t.Errorf("unmarshal %s failed: %s", data, err)
+		} else if code != 200 {
+			t.Errorf("unmarshal %s = %d, want 200", data, code)
+		}
+	}
+	var code api.FlexibleInt
+	if err := json.Unmarshal([]byte(`"ok"`), &code); err == nil {
+		t.Error("expected an error for a non numeric string")
+	}
+}
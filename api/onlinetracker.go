@@ -0,0 +1,47 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// OnlineTracker remembers when each user IP was last reported online, so an IP missing from a single
+// poll is still counted for the device limit until it has not been seen for Window
+type OnlineTracker struct {
+	Window   time.Duration // 0 for disable, only the IPs of the current poll are reported
+	mu       sync.Mutex
+	lastSeen map[OnlineUser]time.Time
+}
+
+// Track records the online users of the current poll and returns every user IP seen within Window,
+// sorted by UID and IP. The IPs not seen for Window are aged out.
+func (t *OnlineTracker) Track(onlineUserList []OnlineUser) []OnlineUser {
+	if t.Window <= 0 {
+		return onlineUserList
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastSeen == nil {
+		t.lastSeen = make(map[OnlineUser]time.Time)
+	}
+	now := time.Now()
+	for _, user := range onlineUserList {
+		t.lastSeen[user] = now
+	}
+	onlineUsers := make([]OnlineUser, 0, len(t.lastSeen))
+	for user, seen := range t.lastSeen {
+		if now.Sub(seen) > t.Window {
+			delete(t.lastSeen, user)
+			continue
+		}
+		onlineUsers = append(onlineUsers, user)
+	}
+	sort.Slice(onlineUsers, func(i, j int) bool {
+		if onlineUsers[i].UID != onlineUsers[j].UID {
+			return onlineUsers[i].UID < onlineUsers[j].UID
+		}
+		return onlineUsers[i].IP < onlineUsers[j].IP
+	})
+	return onlineUsers
+}
@@ -0,0 +1,37 @@
+package api_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestOnlineTracker(t *testing.T) {
+	tracker := api.OnlineTracker{Window: 50 * time.Millisecond}
+	old := api.OnlineUser{UID: 1, IP: "1.1.1.1"}
+	tracker.Track([]api.OnlineUser{old})
+
+	// Still within the window although missing from this poll
+	recent := api.OnlineUser{UID: 1, IP: "2.2.2.2"}
+	if got := tracker.Track([]api.OnlineUser{recent}); !reflect.DeepEqual(got, []api.OnlineUser{old, recent}) {
+		t.Errorf("expected both IPs within the window, got %v", got)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	current := api.OnlineUser{UID: 2, IP: "3.3.3.3"}
+	tracker.Track([]api.OnlineUser{recent, current})
+	time.Sleep(30 * time.Millisecond)
+	if got := tracker.Track(nil); !reflect.DeepEqual(got, []api.OnlineUser{recent, current}) {
+		t.Errorf("expected the IP older than the window to be excluded, got %v", got)
+	}
+}
+
+func TestOnlineTrackerDisabled(t *testing.T) {
+	var tracker api.OnlineTracker
+	tracker.Track([]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}})
+	if got := tracker.Track([]api.OnlineUser{{UID: 1, IP: "2.2.2.2"}}); len(got) != 1 || got[0].IP != "2.2.2.2" {
+		t.Errorf("expected only the current IPs without a window, got %v", got)
+	}
+}
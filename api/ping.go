@@ -0,0 +1,19 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// ErrNodeNotFound is returned by Ping when the panel accepts the key but returns no node info for the NodeID
+var ErrNodeNotFound = errors.New("the panel returned no node info for the node")
+
+// CheckNodeInfoData returns ErrNodeNotFound if the data of a node info response is empty
+func CheckNodeInfoData(data json.RawMessage) error {
+	switch string(bytes.TrimSpace(data)) {
+	case "", "null", "{}", "[]", `""`:
+		return ErrNodeNotFound
+	}
+	return nil
+}
@@ -64,6 +64,7 @@ type UserTraffic struct {
 type RuleItem struct {
 	ID      int    `json:"id"`
 	Content string `json:"regex"`
+	Type    string `json:"rule_type"` // Optional, see api.ParseRuleType
 }
 
 type IllegalItem struct {
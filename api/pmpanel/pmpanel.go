@@ -1,11 +1,10 @@
 package pmpanel
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -26,90 +25,69 @@ var (
 
 // APIClient create a api client to the panel.
 type APIClient struct {
-	client        *resty.Client
-	APIHost       string
-	NodeID        int
-	Key           string
-	NodeType      string
-	EnableVless   bool
-	EnableXTLS    bool
-	SpeedLimit    float64
-	DeviceLimit   int
-	LocalRuleList []api.DetectRule
+	*api.ClientBase
+	client           *resty.Client
+	APIHost          string
+	NodeID           int
+	Key              string
+	NodeType         string
+	EnableVless      bool
+	EnableXTLS       bool
+	SpeedLimit       float64
+	DeviceLimit      int
+	DryRun           bool
+	DefaultTransport string
+	TrafficBatchSize int
+	userListGuard    api.UserListGuard
+	onlineTracker    api.OnlineTracker
+	nodeInfoCache    api.NodeInfoCache
+	ipHasher         *api.IPHasher
+}
+
+func init() {
+	api.Register("PMpanel", func(apiConfig *api.Config) (api.API, error) {
+		apiClient, err := New(apiConfig)
+		if err != nil {
+			return nil, err
+		}
+		return apiClient, nil
+	})
 }
 
 // New creat a api instance
-func New(apiConfig *api.Config) *APIClient {
+func New(apiConfig *api.Config) (*APIClient, error) {
 
-	client := resty.New()
-	client.SetRetryCount(3)
-	if apiConfig.Timeout > 0 {
-		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
-	} else {
-		client.SetTimeout(5 * time.Second)
+	ipHasher, err := api.NewIPHasher(apiConfig)
+	if err != nil {
+		return nil, err
+	}
+	client, apiHost, err := api.NewRestyClient(apiConfig)
+	if err != nil {
+		return nil, err
 	}
-	client.OnError(func(req *resty.Request, err error) {
-		if v, ok := err.(*resty.ResponseError); ok {
-			// v.Response contains the last response from the server
-			// v.Err contains the original error
-			log.Print(v.Err)
-		}
-	})
-	client.SetHostURL(apiConfig.APIHost)
 	// Create Key for each requests
 	client.SetHeaders(map[string]string{
 		"key": apiConfig.Key,
 	})
-	// Read local rule list
-	localRuleList := readLocalRuleList(apiConfig.RuleListPath)
 	apiClient := &APIClient{
-		client:        client,
-		NodeID:        apiConfig.NodeID,
-		Key:           apiConfig.Key,
-		APIHost:       apiConfig.APIHost,
-		NodeType:      apiConfig.NodeType,
-		EnableVless:   apiConfig.EnableVless,
-		EnableXTLS:    apiConfig.EnableXTLS,
-		SpeedLimit:    apiConfig.SpeedLimit,
-		DeviceLimit:   apiConfig.DeviceLimit,
-		LocalRuleList: localRuleList,
-	}
-	return apiClient
-}
-
-// readLocalRuleList reads the local rule list file
-func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
-
-	LocalRuleList = make([]api.DetectRule, 0)
-	if path != "" {
-		// open the file
-		file, err := os.Open(path)
-
-		//handle errors while opening
-		if err != nil {
-			log.Printf("Error when opening file: %s", err)
-			return LocalRuleList
-		}
-
-		fileScanner := bufio.NewScanner(file)
-
-		// read line by line
-		for fileScanner.Scan() {
-			LocalRuleList = append(LocalRuleList, api.DetectRule{
-				ID:      -1,
-				Pattern: fileScanner.Text(),
-			})
-		}
-		// handle first encountered error while reading
-		if err := fileScanner.Err(); err != nil {
-			log.Fatalf("Error while reading file: %s", err)
-			return make([]api.DetectRule, 0)
-		}
-
-		file.Close()
-	}
-
-	return LocalRuleList
+		ClientBase:       api.NewClientBase(apiConfig, client, apiHost),
+		client:           client,
+		NodeID:           apiConfig.NodeID,
+		Key:              apiConfig.Key,
+		APIHost:          apiHost,
+		NodeType:         apiConfig.NodeType,
+		EnableVless:      apiConfig.EnableVless,
+		EnableXTLS:       apiConfig.EnableXTLS,
+		SpeedLimit:       apiConfig.SpeedLimit,
+		DeviceLimit:      apiConfig.DeviceLimit,
+		DryRun:           apiConfig.DryRun,
+		DefaultTransport: api.DefaultTransportOf(apiConfig),
+		TrafficBatchSize: apiConfig.TrafficBatchSize,
+		userListGuard:    api.UserListGuard{RejectEmpty: apiConfig.RejectEmptyUserList},
+		onlineTracker:    api.OnlineTracker{Window: time.Duration(apiConfig.OnlineWindow) * time.Second},
+		ipHasher:         ipHasher,
+	}
+	return apiClient, nil
 }
 
 // Describe return a description of the client
@@ -122,30 +100,111 @@ func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
 }
 
+// Ping fetches /api/node of the node type and checks it carries node info data
+func (c *APIClient) Ping(ctx context.Context) error {
+	ctx = api.WithRetryEndpoint(ctx, "node_info")
+	var nodeType = ""
+	switch c.NodeType {
+	case "Shadowsocks":
+		nodeType = "ss"
+	case "V2ray":
+		nodeType = "v2ray"
+	case "Trojan":
+		nodeType = "trojan"
+	default:
+		return fmt.Errorf("NodeType Error: %s", c.NodeType)
+	}
+	path := "/api/node"
+	res, err := c.client.R().SetContext(ctx).
+		SetQueryParams(map[string]string{
+			"type":   nodeType,
+			"nodeId": strconv.Itoa(c.NodeID),
+		}).
+		SetResult(&Response{}).
+		ForceContentType("application/json").
+		Get(path)
+	response, err := c.parseResponse(res, path, err)
+	if err != nil {
+		return err
+	}
+	return api.CheckNodeInfoData(response.Data)
+}
+
+// SelfTest fetches the node and rules of the node type, and probes its users and the online and traffic reports by HEAD
+func (c *APIClient) SelfTest(ctx context.Context) map[string]error {
+	var nodeType = ""
+	switch c.NodeType {
+	case "Shadowsocks":
+		nodeType = "ss"
+	case "V2ray":
+		nodeType = "v2ray"
+	case "Trojan":
+		nodeType = "trojan"
+	default:
+		return map[string]error{"node_info": fmt.Errorf("NodeType Error: %s", c.NodeType)}
+	}
+	params := map[string]string{
+		"type":   nodeType,
+		"nodeId": strconv.Itoa(c.NodeID),
+	}
+	result := make(map[string]error)
+	for name, path := range map[string]string{
+		"node_info": "/api/node",
+		"node_rule": "/api/rules",
+	} {
+		res, err := c.client.R().SetContext(ctx).
+			SetQueryParams(params).
+			SetResult(&Response{}).
+			ForceContentType("application/json").
+			Get(path)
+		_, result[name] = c.parseResponse(res, path, err)
+	}
+	for name, path := range map[string]string{
+		"online_users": "/api/online",
+		"user_traffic": "/api/traffic",
+	} {
+		result[name] = api.CheckHeadEndpoint(c.client.R().SetContext(ctx), path)
+	}
+	result["user_list"] = api.CheckHeadEndpoint(c.client.R().SetContext(ctx).SetQueryParams(params), "/api/users")
+	return result
+}
+
 func (c *APIClient) assembleURL(path string) string {
 	return c.APIHost + path
 }
 
 func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (*Response, error) {
 	if err != nil {
-		return nil, fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)
+		statusCode := 0
+		if res != nil {
+			statusCode = res.StatusCode()
+		}
+		return nil, api.NewRequestError(c.assembleURL(path), statusCode, err)
 	}
 
+	if api.IsRedirect(res.StatusCode()) {
+		return nil, &api.APIError{Kind: api.HTTPError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: "redirect to " + res.Header().Get("Location") + " not followed"}
+	}
+	if rateLimitErr := api.NewRateLimitError(c.assembleURL(path), res); rateLimitErr != nil {
+		return nil, rateLimitErr
+	}
 	if res.StatusCode() > 400 {
 		body := res.Body()
-		return nil, fmt.Errorf("request %s failed: %s, %s", c.assembleURL(path), string(body), err)
+		return nil, &api.APIError{Kind: api.HTTPError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: string(body)}
 	}
 	response := res.Result().(*Response)
 
 	if response.Ret != 200 {
-		res, _ := json.Marshal(&response)
-		return nil, fmt.Errorf("Ret %s invalid", string(res))
+		body, _ := json.Marshal(&response)
+		return nil, &api.APIError{Kind: api.PanelError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: string(body)}
 	}
 	return response, nil
 }
 
 // GetNodeInfo will pull NodeInfo Config from sspanel
-func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
+func (c *APIClient) GetNodeInfo(ctx context.Context) (nodeInfo *api.NodeInfo, err error) {
+	defer c.Emitter.Poll("node_info", &err)
+	ctx = api.WithRetryEndpoint(ctx, "node_info")
 	path := fmt.Sprintf("/api/node")
 	var nodeType = ""
 	switch c.NodeType {
@@ -159,7 +218,7 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 		return nil, fmt.Errorf("NodeType Error: %s", c.NodeType)
 	}
 	// body := fmt.Sprintf(`{"type":"%s", "nodeId":%d}`, nodeType, c.NodeID)
-	res, err := c.client.R().
+	res, err := c.nodeInfoCache.SetIfNoneMatch(c.client.R().SetContext(ctx)).
 		SetQueryParams(map[string]string{
 			"type":   nodeType,
 			"nodeId": strconv.Itoa(c.NodeID),
@@ -168,6 +227,9 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 		ForceContentType("application/json").
 		Get(path)
 
+	if cached, ok := c.nodeInfoCache.NotModified(res); ok && err == nil {
+		return cached, api.ErrNodeInfoNotModified
+	}
 	response, err := c.parseResponse(res, path, err)
 	if err != nil {
 		return nil, err
@@ -194,11 +256,17 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 		return nil, fmt.Errorf("Parse node info failed: %s", string(res))
 	}
 
+	c.Metrics.RecordResponse(c.client, "node_info", res)
+	api.FinishNodeInfo(nodeInfo, c.DefaultTransport)
+	c.nodeInfoCache.Store(res, nodeInfo)
+	c.Emitter.NodeInfo(nodeInfo)
 	return nodeInfo, nil
 }
 
 // GetUserList will pull user form sspanel
-func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
+func (c *APIClient) GetUserList(ctx context.Context) (UserList *[]api.UserInfo, err error) {
+	defer c.Emitter.Poll("user_list", &err)
+	ctx = api.WithRetryEndpoint(ctx, "user_list")
 	path := "/api/users"
 	var nodeType = ""
 	switch c.NodeType {
@@ -211,7 +279,7 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 	default:
 		return nil, fmt.Errorf("NodeType Error: %s", c.NodeType)
 	}
-	res, err := c.client.R().
+	res, err := c.client.R().SetContext(ctx).
 		SetQueryParams(map[string]string{
 			"type":   nodeType,
 			"nodeId": strconv.Itoa(c.NodeID),
@@ -235,16 +303,21 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 		res, _ := json.Marshal(userListResponse)
 		return nil, fmt.Errorf("Parse user list failed: %s", string(res))
 	}
+	if err := c.userListGuard.Check(userList); err != nil {
+		return nil, err
+	}
+	c.Metrics.RecordUserList(c.client, res, len(*userList))
 	return userList, nil
 }
 
 // ReportNodeStatus reports the node status to the sspanel
-func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
+func (c *APIClient) ReportNodeStatus(ctx context.Context, nodeStatus *api.NodeStatus) (err error) {
 	return nil
 }
 
 //ReportNodeOnlineUsers reports online user ip
-func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) error {
+func (c *APIClient) ReportNodeOnlineUsers(ctx context.Context, onlineUserList *[]api.OnlineUser) error {
+	ctx = api.WithRetryEndpoint(ctx, "report")
 	var nodeType = ""
 	switch c.NodeType {
 	case "Shadowsocks":
@@ -256,14 +329,22 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 	default:
 		return fmt.Errorf("NodeType Error: %s", c.NodeType)
 	}
-	data := make([]OnlineUser, len(*onlineUserList))
-	for i, user := range *onlineUserList {
-		data[i] = OnlineUser{UID: user.UID, IP: user.IP}
+	onlineUsers := c.onlineTracker.Track(*onlineUserList)
+	if len(onlineUsers) == 0 {
+		return nil
+	}
+	data := make([]OnlineUser, len(onlineUsers))
+	for i, user := range onlineUsers {
+		data[i] = OnlineUser{UID: user.UID, IP: c.ipHasher.Hash(user.IP)}
 	}
 	postData := &PostData{Type: nodeType, NodeId: c.NodeID, Onlines: data}
 	path := "/api/online"
 
-	res, err := c.client.R().
+	if c.DryRun {
+		api.LogDryRun(path, postData)
+		return nil
+	}
+	res, err := c.client.R().SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetBody(postData).
 		SetResult(&Response{}).
@@ -278,7 +359,12 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 }
 
 // ReportUserTraffic reports the user traffic
-func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
+func (c *APIClient) ReportUserTraffic(ctx context.Context, userTraffic *[]api.UserTraffic) error {
+	return api.ReportInBatches(api.WithRetryEndpoint(ctx, "report"), *userTraffic, c.TrafficBatchSize, c.reportUserTraffic)
+}
+
+// reportUserTraffic reports a single batch of user traffic
+func (c *APIClient) reportUserTraffic(ctx context.Context, userTraffic []api.UserTraffic) error {
 	var nodeType = ""
 	switch c.NodeType {
 	case "Shadowsocks":
@@ -290,8 +376,8 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 	default:
 		return fmt.Errorf("NodeType Error: %s", c.NodeType)
 	}
-	data := make([]UserTraffic, len(*userTraffic))
-	for i, traffic := range *userTraffic {
+	data := make([]UserTraffic, len(userTraffic))
+	for i, traffic := range userTraffic {
 		data[i] = UserTraffic{
 			UID:      traffic.UID,
 			Upload:   traffic.Upload,
@@ -301,7 +387,11 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 	postData := &PostData{Type: nodeType, NodeId: c.NodeID, Users: data}
 	path := "/api/traffic"
 
-	res, err := c.client.R().
+	if c.DryRun {
+		api.LogDryRun(path, postData)
+		return nil
+	}
+	res, err := c.client.R().SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetBody(postData).
 		SetResult(&Response{}).
@@ -316,8 +406,17 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 }
 
 // GetNodeRule will pull the audit rule form pmpanel
-func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
-	ruleList := c.LocalRuleList
+func (c *APIClient) GetNodeRule(ctx context.Context) (ruleList *[]api.DetectRule, err error) {
+	defer c.Emitter.Poll("node_rule", &err)
+	ctx = api.WithRetryEndpoint(ctx, "node_rule")
+	return c.RuleCache.Get(func() (*[]api.DetectRule, error) {
+		return c.getNodeRule(ctx)
+	})
+}
+
+// getNodeRule fetches the rule list bypassing the cache
+func (c *APIClient) getNodeRule(ctx context.Context) (*[]api.DetectRule, error) {
+	ruleList := api.LocalRules(&c.Config)
 	path := "/api/rules"
 	var nodeType = ""
 	switch c.NodeType {
@@ -330,7 +429,7 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	default:
 		return nil, fmt.Errorf("NodeType Error: %s", c.NodeType)
 	}
-	res, err := c.client.R().
+	res, err := c.client.R().SetContext(ctx).
 		SetQueryParams(map[string]string{
 			"type":   nodeType,
 			"nodeId": strconv.Itoa(c.NodeID),
@@ -351,16 +450,24 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	}
 
 	for _, r := range *ruleListResponse {
-		ruleList = append(ruleList, api.DetectRule{
-			ID:      r.ID,
-			Pattern: r.Content,
-		})
+		ruleType, ok := api.ParseRuleType(r.Type)
+		if !ok {
+			log.Printf("Skip the rule %d of unsupported type %s", r.ID, r.Type)
+			continue
+		}
+		rule, err := api.NewDetectRule(r.ID, ruleType, r.Content)
+		if err != nil {
+			log.Printf("Skip the invalid rule %d: %s", r.ID, err)
+			continue
+		}
+		ruleList = append(ruleList, rule)
 	}
 	return &ruleList, nil
 }
 
 // ReportIllegal reports the user illegal behaviors
-func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
+func (c *APIClient) ReportIllegal(ctx context.Context, detectResultList *[]api.DetectResult) error {
+	c.Emitter.RuleHit(*detectResultList)
 	return nil
 }
 
@@ -1,6 +1,7 @@
 package pmpanel_test
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -15,14 +16,17 @@ func CreateClient() api.API {
 		NodeID:   4,
 		NodeType: "V2ray",
 	}
-	client := pmpanel.New(apiConfig)
+	client, err := pmpanel.New(apiConfig)
+	if err != nil {
+		panic(err)
+	}
 	return client
 }
 
 func TestGetV2rayNodeinfo(t *testing.T) {
 	client := CreateClient()
 	client.Debug()
-	nodeInfo, err := client.GetNodeInfo()
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -36,9 +40,12 @@ func TestGetSSNodeinfo(t *testing.T) {
 		NodeID:   1,
 		NodeType: "Shadowsocks",
 	}
-	client := pmpanel.New(apiConfig)
+	client, err := pmpanel.New(apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
 	client.Debug()
-	nodeInfo, err := client.GetNodeInfo()
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -52,9 +59,12 @@ func TestGetTrojanNodeinfo(t *testing.T) {
 		NodeID:   1,
 		NodeType: "Trojan",
 	}
-	client := pmpanel.New(apiConfig)
+	client, err := pmpanel.New(apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
 	client.Debug()
-	nodeInfo, err := client.GetNodeInfo()
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -64,7 +74,7 @@ func TestGetTrojanNodeinfo(t *testing.T) {
 func TestGetSSinfo(t *testing.T) {
 	client := CreateClient()
 
-	nodeInfo, err := client.GetNodeInfo()
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -74,7 +84,7 @@ func TestGetSSinfo(t *testing.T) {
 func TestGetUserList(t *testing.T) {
 	client := CreateClient()
 
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -85,9 +95,9 @@ func TestGetUserList(t *testing.T) {
 func TestReportNodeStatus(t *testing.T) {
 	client := CreateClient()
 	nodeStatus := &api.NodeStatus{
-		1, 1, 1, 256,
+		CPU: 1, Mem: 1, Disk: 1, Uptime: 256,
 	}
-	err := client.ReportNodeStatus(nodeStatus)
+	err := client.ReportNodeStatus(context.Background(), nodeStatus)
 	if err != nil {
 		t.Error(err)
 	}
@@ -95,7 +105,7 @@ func TestReportNodeStatus(t *testing.T) {
 
 func TestReportReportNodeOnlineUsers(t *testing.T) {
 	client := CreateClient()
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -108,7 +118,7 @@ func TestReportReportNodeOnlineUsers(t *testing.T) {
 		}
 	}
 	//client.Debug()
-	err = client.ReportNodeOnlineUsers(&onlineUserList)
+	err = client.ReportNodeOnlineUsers(context.Background(), &onlineUserList)
 	if err != nil {
 		t.Error(err)
 	}
@@ -116,7 +126,7 @@ func TestReportReportNodeOnlineUsers(t *testing.T) {
 
 func TestReportReportUserTraffic(t *testing.T) {
 	client := CreateClient()
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -129,7 +139,7 @@ func TestReportReportUserTraffic(t *testing.T) {
 		}
 	}
 	//client.Debug()
-	err = client.ReportUserTraffic(&generalUserTraffic)
+	err = client.ReportUserTraffic(context.Background(), &generalUserTraffic)
 	if err != nil {
 		t.Error(err)
 	}
@@ -138,7 +148,7 @@ func TestReportReportUserTraffic(t *testing.T) {
 func TestGetNodeRule(t *testing.T) {
 	client := CreateClient()
 
-	ruleList, err := client.GetNodeRule()
+	ruleList, err := client.GetNodeRule(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -154,7 +164,7 @@ func TestReportIllegal(t *testing.T) {
 		api.DetectResult{1, 3},
 	}
 	client.Debug()
-	err := client.ReportIllegal(&detectResult)
+	err := client.ReportIllegal(context.Background(), &detectResult)
 	if err != nil {
 		t.Error(err)
 	}
@@ -1,10 +1,14 @@
 package proxypanel
 
-import "encoding/json"
+import (
+	"encoding/json"
+
+	"github.com/XrayR-project/XrayR/api"
+)
 
 type Response struct {
 	Status  string          `json:"status"`
-	Code    int             `json:"code"`
+	Code    api.FlexibleInt `json:"code"`
 	Data    json.RawMessage `json:"data"`
 	Message string          `json:"message"`
 }
@@ -58,11 +62,12 @@ type TrojanNodeInfo struct {
 
 // Node status report
 type NodeStatus struct {
-	CPU    string `json:"cpu"`
-	Mem    string `json:"mem"`
-	Net    string `json:"net"`
-	Disk   string `json:"disk"`
-	Uptime int    `json:"uptime"`
+	CPU     string  `json:"cpu"`
+	Mem     string  `json:"mem"`
+	Net     string  `json:"net"`
+	Disk    string  `json:"disk"`
+	Uptime  int     `json:"uptime"`
+	CPUTemp float64 `json:"cpu_temp,omitempty"`
 }
 
 type NodeOnline struct {
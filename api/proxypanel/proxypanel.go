@@ -1,11 +1,10 @@
 package proxypanel
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"reflect"
 	"strconv"
 	"time"
@@ -16,86 +15,67 @@ import (
 
 // APIClient create a api client to the panel.
 type APIClient struct {
-	client        *resty.Client
-	APIHost       string
-	NodeID        int
-	Key           string
-	NodeType      string
-	EnableVless   bool
-	EnableXTLS    bool
-	SpeedLimit    float64
-	DeviceLimit   int
-	LocalRuleList []api.DetectRule
+	*api.ClientBase
+	client           *resty.Client
+	APIHost          string
+	NodeID           int
+	Key              string
+	NodeType         string
+	EnableVless      bool
+	EnableXTLS       bool
+	SpeedLimit       float64
+	DeviceLimit      int
+	DryRun           bool
+	DefaultTransport string
+	TrafficBatchSize int
+	userListGuard    api.UserListGuard
+	illegalDedup     api.IllegalReportDedup
+	onlineTracker    api.OnlineTracker
+	nodeInfoCache    api.NodeInfoCache
+	ipHasher         *api.IPHasher
 }
 
-// New creat a api instance
-func New(apiConfig *api.Config) *APIClient {
-
-	client := resty.New()
-	client.SetRetryCount(3)
-	if apiConfig.Timeout > 0 {
-		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
-	} else {
-		client.SetTimeout(5 * time.Second)
-	}
-	client.OnError(func(req *resty.Request, err error) {
-		if v, ok := err.(*resty.ResponseError); ok {
-			// v.Response contains the last response from the server
-			// v.Err contains the original error
-			log.Print(v.Err)
+func init() {
+	api.Register("Proxypanel", func(apiConfig *api.Config) (api.API, error) {
+		apiClient, err := New(apiConfig)
+		if err != nil {
+			return nil, err
 		}
+		return apiClient, nil
 	})
-	client.SetHostURL(apiConfig.APIHost)
-	// Read local rule list
-	localRuleList := readLocalRuleList(apiConfig.RuleListPath)
-	apiClient := &APIClient{
-		client:        client,
-		NodeID:        apiConfig.NodeID,
-		Key:           apiConfig.Key,
-		APIHost:       apiConfig.APIHost,
-		NodeType:      apiConfig.NodeType,
-		EnableVless:   apiConfig.EnableVless,
-		EnableXTLS:    apiConfig.EnableXTLS,
-		SpeedLimit:    apiConfig.SpeedLimit,
-		DeviceLimit:   apiConfig.DeviceLimit,
-		LocalRuleList: localRuleList,
-	}
-	return apiClient
 }
 
-// readLocalRuleList reads the local rule list file
-func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
-
-	LocalRuleList = make([]api.DetectRule, 0)
-	if path != "" {
-		// open the file
-		file, err := os.Open(path)
-
-		//handle errors while opening
-		if err != nil {
-			log.Printf("Error when opening file: %s", err)
-			return LocalRuleList
-		}
-
-		fileScanner := bufio.NewScanner(file)
-
-		// read line by line
-		for fileScanner.Scan() {
-			LocalRuleList = append(LocalRuleList, api.DetectRule{
-				ID:      -1,
-				Pattern: fileScanner.Text(),
-			})
-		}
-		// handle first encountered error while reading
-		if err := fileScanner.Err(); err != nil {
-			log.Fatalf("Error while reading file: %s", err)
-			return make([]api.DetectRule, 0)
-		}
+// New creat a api instance
+func New(apiConfig *api.Config) (*APIClient, error) {
 
-		file.Close()
+	ipHasher, err := api.NewIPHasher(apiConfig)
+	if err != nil {
+		return nil, err
 	}
-
-	return LocalRuleList
+	client, apiHost, err := api.NewRestyClient(apiConfig)
+	if err != nil {
+		return nil, err
+	}
+	apiClient := &APIClient{
+		ClientBase:       api.NewClientBase(apiConfig, client, apiHost),
+		client:           client,
+		NodeID:           apiConfig.NodeID,
+		Key:              apiConfig.Key,
+		APIHost:          apiHost,
+		NodeType:         apiConfig.NodeType,
+		EnableVless:      apiConfig.EnableVless,
+		EnableXTLS:       apiConfig.EnableXTLS,
+		SpeedLimit:       apiConfig.SpeedLimit,
+		DeviceLimit:      apiConfig.DeviceLimit,
+		DryRun:           apiConfig.DryRun,
+		DefaultTransport: api.DefaultTransportOf(apiConfig),
+		TrafficBatchSize: apiConfig.TrafficBatchSize,
+		userListGuard:    api.UserListGuard{RejectEmpty: apiConfig.RejectEmptyUserList},
+		onlineTracker:    api.OnlineTracker{Window: time.Duration(apiConfig.OnlineWindow) * time.Second},
+		illegalDedup:     api.IllegalReportDedup{Cooldown: api.IllegalReportCooldown(apiConfig.IllegalCooldown)},
+		ipHasher:         ipHasher,
+	}
+	return apiClient, nil
 }
 
 // Describe return a description of the client
@@ -108,6 +88,63 @@ func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
 }
 
+// Ping fetches the node info of the V2ray or Trojan node and checks it carries node info data
+func (c *APIClient) Ping(ctx context.Context) error {
+	ctx = api.WithRetryEndpoint(ctx, "node_info")
+	var path string
+	switch c.NodeType {
+	case "V2ray":
+		path = fmt.Sprintf("/api/v2ray/v1/node/%d", c.NodeID)
+	case "Trojan":
+		path = fmt.Sprintf("/api/trojan/v1/node/%d", c.NodeID)
+	default:
+		return fmt.Errorf("Unsupported Node type: %s", c.NodeType)
+	}
+	res, err := c.createCommonRequest().SetContext(ctx).
+		SetResult(&Response{}).
+		ForceContentType("application/json").
+		Get(path)
+	response, err := c.parseResponse(res, path, err)
+	if err != nil {
+		return err
+	}
+	return api.CheckNodeInfoData(response.Data)
+}
+
+// SelfTest fetches the node info and node rules under the node type prefix, and probes the user list and the reports by HEAD
+func (c *APIClient) SelfTest(ctx context.Context) map[string]error {
+	var prefix string
+	switch c.NodeType {
+	case "V2ray":
+		prefix = "/api/v2ray/v1"
+	case "Trojan":
+		prefix = "/api/trojan/v1"
+	default:
+		return map[string]error{"node_info": fmt.Errorf("Unsupported Node type: %s", c.NodeType)}
+	}
+	result := make(map[string]error)
+	for name, path := range map[string]string{
+		"node_info": fmt.Sprintf("%s/node/%d", prefix, c.NodeID),
+		"node_rule": fmt.Sprintf("%s/nodeRule/%d", prefix, c.NodeID),
+	} {
+		res, err := c.createCommonRequest().SetContext(ctx).
+			SetResult(&Response{}).
+			ForceContentType("application/json").
+			Get(path)
+		_, result[name] = c.parseResponse(res, path, err)
+	}
+	for name, path := range map[string]string{
+		"user_list":    fmt.Sprintf("%s/userList/%d", prefix, c.NodeID),
+		"node_status":  fmt.Sprintf("%s/nodeStatus/%d", prefix, c.NodeID),
+		"online_users": fmt.Sprintf("%s/nodeOnline/%d", prefix, c.NodeID),
+		"user_traffic": fmt.Sprintf("%s/userTraffic/%d", prefix, c.NodeID),
+		"illegal":      fmt.Sprintf("%s/trigger/%d", prefix, c.NodeID),
+	} {
+		result[name] = api.CheckHeadEndpoint(c.createCommonRequest().SetContext(ctx), path)
+	}
+	return result
+}
+
 func (c *APIClient) assembleURL(path string) string {
 	return c.APIHost + path
 }
@@ -122,24 +159,36 @@ func (c *APIClient) createCommonRequest() *resty.Request {
 
 func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (*Response, error) {
 	if err != nil {
-		return nil, fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)
+		statusCode := 0
+		if res != nil {
+			statusCode = res.StatusCode()
+		}
+		return nil, api.NewRequestError(c.assembleURL(path), statusCode, err)
 	}
 
+	if api.IsRedirect(res.StatusCode()) {
+		return nil, &api.APIError{Kind: api.HTTPError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: "redirect to " + res.Header().Get("Location") + " not followed"}
+	}
+	if rateLimitErr := api.NewRateLimitError(c.assembleURL(path), res); rateLimitErr != nil {
+		return nil, rateLimitErr
+	}
 	if res.StatusCode() > 400 {
 		body := res.Body()
-		return nil, fmt.Errorf("request %s failed: %s, %s", c.assembleURL(path), string(body), err)
+		return nil, &api.APIError{Kind: api.HTTPError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: string(body)}
 	}
 	response := res.Result().(*Response)
 
 	if response.Status != "success" {
-		res, _ := json.Marshal(&response)
-		return nil, fmt.Errorf("Ret %s invalid", string(res))
+		body, _ := json.Marshal(&response)
+		return nil, &api.APIError{Kind: api.PanelError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: string(body)}
 	}
 	return response, nil
 }
 
 // GetNodeInfo will pull NodeInfo Config from sspanel
-func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
+func (c *APIClient) GetNodeInfo(ctx context.Context) (nodeInfo *api.NodeInfo, err error) {
+	defer c.Emitter.Poll("node_info", &err)
+	ctx = api.WithRetryEndpoint(ctx, "node_info")
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -152,11 +201,14 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 		return nil, fmt.Errorf("Unsupported Node type: %s", c.NodeType)
 	}
 
-	res, err := c.createCommonRequest().
+	res, err := c.nodeInfoCache.SetIfNoneMatch(c.createCommonRequest().SetContext(ctx)).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
 		Get(path)
 
+	if cached, ok := c.nodeInfoCache.NotModified(res); ok && err == nil {
+		return cached, api.ErrNodeInfoNotModified
+	}
 	response, err := c.parseResponse(res, path, err)
 	if err != nil {
 		return nil, err
@@ -178,11 +230,17 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 		return nil, fmt.Errorf("Parse node info failed: %s", string(res))
 	}
 
+	c.Metrics.RecordResponse(c.client, "node_info", res)
+	api.FinishNodeInfo(nodeInfo, c.DefaultTransport)
+	c.nodeInfoCache.Store(res, nodeInfo)
+	c.Emitter.NodeInfo(nodeInfo)
 	return nodeInfo, nil
 }
 
 // GetUserList will pull user form sspanel
-func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
+func (c *APIClient) GetUserList(ctx context.Context) (UserList *[]api.UserInfo, err error) {
+	defer c.Emitter.Poll("user_list", &err)
+	ctx = api.WithRetryEndpoint(ctx, "user_list")
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -195,7 +253,7 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 		return nil, fmt.Errorf("Unsupported Node type: %s", c.NodeType)
 	}
 
-	res, err := c.createCommonRequest().
+	res, err := c.createCommonRequest().SetContext(ctx).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
 		Get(path)
@@ -219,11 +277,16 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 		res, _ := json.Marshal(response.Data)
 		return nil, fmt.Errorf("Parse user list failed: %s", string(res))
 	}
+	if err := c.userListGuard.Check(userList); err != nil {
+		return nil, err
+	}
+	c.Metrics.RecordUserList(c.client, res, len(*userList))
 	return userList, nil
 }
 
 // ReportNodeStatus reports the node status to the sspanel
-func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
+func (c *APIClient) ReportNodeStatus(ctx context.Context, nodeStatus *api.NodeStatus) (err error) {
+	ctx = api.WithRetryEndpoint(ctx, "report")
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -237,13 +300,14 @@ func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
 	}
 
 	systemload := NodeStatus{
-		Uptime: nodeStatus.Uptime,
-		CPU:    fmt.Sprintf("%d%%", int(nodeStatus.CPU)),
-		Mem:    fmt.Sprintf("%d%%", int(nodeStatus.Mem)),
-		Disk:   fmt.Sprintf("%d%%", int(nodeStatus.Disk)),
+		Uptime:  nodeStatus.Uptime,
+		CPU:     fmt.Sprintf("%d%%", int(nodeStatus.CPU)),
+		Mem:     fmt.Sprintf("%d%%", int(nodeStatus.Mem)),
+		Disk:    fmt.Sprintf("%d%%", int(nodeStatus.Disk)),
+		CPUTemp: api.CPUTemp(&c.Config, nodeStatus),
 	}
 
-	res, err := c.createCommonRequest().
+	res, err := c.createCommonRequest().SetContext(ctx).
 		SetBody(systemload).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
@@ -258,7 +322,8 @@ func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
 }
 
 //ReportNodeOnlineUsers reports online user ip
-func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) error {
+func (c *APIClient) ReportNodeOnlineUsers(ctx context.Context, onlineUserList *[]api.OnlineUser) error {
+	ctx = api.WithRetryEndpoint(ctx, "report")
 
 	var path string
 	switch c.NodeType {
@@ -272,12 +337,20 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 		return fmt.Errorf("Unsupported Node type: %s", c.NodeType)
 	}
 
-	data := make([]NodeOnline, len(*onlineUserList))
-	for i, user := range *onlineUserList {
-		data[i] = NodeOnline{UID: user.UID, IP: user.IP}
+	onlineUsers := c.onlineTracker.Track(*onlineUserList)
+	if len(onlineUsers) == 0 {
+		return nil
+	}
+	data := make([]NodeOnline, len(onlineUsers))
+	for i, user := range onlineUsers {
+		data[i] = NodeOnline{UID: user.UID, IP: c.ipHasher.Hash(user.IP)}
 	}
 
-	res, err := c.createCommonRequest().
+	if c.DryRun {
+		api.LogDryRun(path, data)
+		return nil
+	}
+	res, err := c.createCommonRequest().SetContext(ctx).
 		SetBody(data).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
@@ -292,7 +365,12 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 }
 
 // ReportUserTraffic reports the user traffic
-func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
+func (c *APIClient) ReportUserTraffic(ctx context.Context, userTraffic *[]api.UserTraffic) error {
+	return api.ReportInBatches(api.WithRetryEndpoint(ctx, "report"), *userTraffic, c.TrafficBatchSize, c.reportUserTraffic)
+}
+
+// reportUserTraffic reports a single batch of user traffic
+func (c *APIClient) reportUserTraffic(ctx context.Context, userTraffic []api.UserTraffic) error {
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -305,14 +383,18 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 		return fmt.Errorf("Unsupported Node type: %s", c.NodeType)
 	}
 
-	data := make([]UserTraffic, len(*userTraffic))
-	for i, traffic := range *userTraffic {
+	data := make([]UserTraffic, len(userTraffic))
+	for i, traffic := range userTraffic {
 		data[i] = UserTraffic{
 			UID:      traffic.UID,
 			Upload:   traffic.Upload,
 			Download: traffic.Download}
 	}
-	res, err := c.createCommonRequest().
+	if c.DryRun {
+		api.LogDryRun(path, data)
+		return nil
+	}
+	res, err := c.createCommonRequest().SetContext(ctx).
 		SetBody(data).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
@@ -327,7 +409,16 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 }
 
 // GetNodeRule will pull the audit rule form sspanel
-func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
+func (c *APIClient) GetNodeRule(ctx context.Context) (ruleList *[]api.DetectRule, err error) {
+	defer c.Emitter.Poll("node_rule", &err)
+	ctx = api.WithRetryEndpoint(ctx, "node_rule")
+	return c.RuleCache.Get(func() (*[]api.DetectRule, error) {
+		return c.getNodeRule(ctx)
+	})
+}
+
+// getNodeRule fetches the rule list bypassing the cache
+func (c *APIClient) getNodeRule(ctx context.Context) (*[]api.DetectRule, error) {
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -340,7 +431,7 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 		return nil, fmt.Errorf("Unsupported Node type: %s", c.NodeType)
 	}
 
-	res, err := c.createCommonRequest().
+	res, err := c.createCommonRequest().SetContext(ctx).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
 		Get(path)
@@ -355,19 +446,24 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	if err := json.Unmarshal(response.Data, ruleListResponse); err != nil {
 		return nil, fmt.Errorf("Unmarshal %s failed: %s", reflect.TypeOf(ruleListResponse), err)
 	}
-	ruleList := c.LocalRuleList
+	ruleList := api.LocalRules(&c.Config)
 	// Only support reject rule type
 	if ruleListResponse.Mode != "reject" {
 		return &ruleList, nil
 	} else {
 		for _, r := range ruleListResponse.Rules {
-			if r.Type == "reg" {
-				ruleList = append(ruleList, api.DetectRule{
-					ID:      r.ID,
-					Pattern: r.Pattern,
-				})
+			// reg, domain and ip, the protocol rules are not supported
+			ruleType, ok := api.ParseRuleType(r.Type)
+			if !ok || r.Type == "" {
+				log.Printf("Skip the rule %d of unsupported type %s", r.ID, r.Type)
+				continue
 			}
-
+			rule, err := api.NewDetectRule(r.ID, ruleType, r.Pattern)
+			if err != nil {
+				log.Printf("Skip the invalid rule %d: %s", r.ID, err)
+				continue
+			}
+			ruleList = append(ruleList, rule)
 		}
 	}
 
@@ -375,7 +471,9 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 }
 
 // ReportIllegal reports the user illegal behaviors
-func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
+func (c *APIClient) ReportIllegal(ctx context.Context, detectResultList *[]api.DetectResult) error {
+	c.Emitter.RuleHit(*detectResultList)
+	ctx = api.WithRetryEndpoint(ctx, "report")
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -388,13 +486,18 @@ func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
 		return fmt.Errorf("Unsupported Node type: %s", c.NodeType)
 	}
 
-	for _, r := range *detectResultList {
-		res, err := c.createCommonRequest().
-			SetBody(IllegalReport{
-				RuleID: r.RuleID,
-				UID:    r.UID,
-				Reason: "XrayR cannot save reason",
-			}).
+	for _, r := range c.illegalDedup.Filter(api.PanelDetectResults(*detectResultList)) {
+		report := IllegalReport{
+			RuleID: r.RuleID,
+			UID:    r.UID,
+			Reason: "XrayR cannot save reason",
+		}
+		if c.DryRun {
+			api.LogDryRun(path, report)
+			continue
+		}
+		res, err := c.createCommonRequest().SetContext(ctx).
+			SetBody(report).
 			SetResult(&Response{}).
 			ForceContentType("application/json").
 			Post(path)
@@ -403,6 +506,7 @@ func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
 		if err != nil {
 			return err
 		}
+		c.illegalDedup.Reported(r)
 	}
 
 	return nil
@@ -1,7 +1,11 @@
 package proxypanel_test
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/XrayR-project/XrayR/api"
@@ -15,7 +19,10 @@ func CreateClient() api.API {
 		NodeID:   1,
 		NodeType: "V2ray",
 	}
-	client := proxypanel.New(apiConfig)
+	client, err := proxypanel.New(apiConfig)
+	if err != nil {
+		panic(err)
+	}
 	return client
 }
 
@@ -26,9 +33,12 @@ func TestGetV2rayNodeinfo(t *testing.T) {
 		NodeID:   1,
 		NodeType: "V2ray",
 	}
-	client := proxypanel.New(apiConfig)
+	client, err := proxypanel.New(apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	nodeInfo, err := client.GetNodeInfo()
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -42,8 +52,11 @@ func TestGetSSNodeinfo(t *testing.T) {
 		NodeID:   3,
 		NodeType: "Shadowsocks",
 	}
-	client := proxypanel.New(apiConfig)
-	nodeInfo, err := client.GetNodeInfo()
+	client, err := proxypanel.New(apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -57,8 +70,11 @@ func TestGetTrojanNodeinfo(t *testing.T) {
 		NodeID:   2,
 		NodeType: "Trojan",
 	}
-	client := proxypanel.New(apiConfig)
-	nodeInfo, err := client.GetNodeInfo()
+	client, err := proxypanel.New(apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -68,7 +84,7 @@ func TestGetTrojanNodeinfo(t *testing.T) {
 func TestGetSSinfo(t *testing.T) {
 	client := CreateClient()
 
-	nodeInfo, err := client.GetNodeInfo()
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -78,7 +94,7 @@ func TestGetSSinfo(t *testing.T) {
 func TestGetUserList(t *testing.T) {
 	client := CreateClient()
 
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -89,9 +105,9 @@ func TestGetUserList(t *testing.T) {
 func TestReportNodeStatus(t *testing.T) {
 	client := CreateClient()
 	nodeStatus := &api.NodeStatus{
-		1, 1, 1, 256,
+		CPU: 1, Mem: 1, Disk: 1, Uptime: 256,
 	}
-	err := client.ReportNodeStatus(nodeStatus)
+	err := client.ReportNodeStatus(context.Background(), nodeStatus)
 	if err != nil {
 		t.Error(err)
 	}
@@ -99,7 +115,7 @@ func TestReportNodeStatus(t *testing.T) {
 
 func TestReportReportNodeOnlineUsers(t *testing.T) {
 	client := CreateClient()
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -112,7 +128,7 @@ func TestReportReportNodeOnlineUsers(t *testing.T) {
 		}
 	}
 	//client.Debug()
-	err = client.ReportNodeOnlineUsers(&onlineUserList)
+	err = client.ReportNodeOnlineUsers(context.Background(), &onlineUserList)
 	if err != nil {
 		t.Error(err)
 	}
@@ -120,7 +136,7 @@ func TestReportReportNodeOnlineUsers(t *testing.T) {
 
 func TestReportReportUserTraffic(t *testing.T) {
 	client := CreateClient()
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -133,7 +149,7 @@ func TestReportReportUserTraffic(t *testing.T) {
 		}
 	}
 	client.Debug()
-	err = client.ReportUserTraffic(&generalUserTraffic)
+	err = client.ReportUserTraffic(context.Background(), &generalUserTraffic)
 	if err != nil {
 		t.Error(err)
 	}
@@ -142,7 +158,7 @@ func TestReportReportUserTraffic(t *testing.T) {
 func TestGetNodeRule(t *testing.T) {
 	client := CreateClient()
 	client.Debug()
-	ruleList, err := client.GetNodeRule()
+	ruleList, err := client.GetNodeRule(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -158,8 +174,104 @@ func TestReportIllegal(t *testing.T) {
 		api.DetectResult{1, 2},
 	}
 	client.Debug()
-	err := client.ReportIllegal(&detectResult)
+	err := client.ReportIllegal(context.Background(), &detectResult)
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+func TestStringResponseCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"success","code":"200","data":[],"message":""}`)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "naBDpLvREiwY9qPr",
+		NodeID:   1,
+		NodeType: "V2ray",
+	}
+	client, err := proxypanel.New(apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetUserList(context.Background()); err != nil {
+		t.Errorf("a numeric string code should be accepted: %s", err)
+	}
+}
+
+func TestNodeRulePayload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"success","code":200,"message":"获取节点审计规则成功","data":{"mode":"reject","rules":[
+			{"id":1,"type":"reg","pattern":"(.*\\.||)(pornhub|xvideos)\\.(com|net)"},
+			{"id":2,"type":"domain","pattern":"Example.com."},
+			{"id":3,"type":"ip","pattern":"1.1.1.1"},
+			{"id":4,"type":"ip","pattern":"10.0.0.0/8"},
+			{"id":5,"type":"protocol","pattern":"BitTorrent protocol"},
+			{"id":6,"type":"reg","pattern":"(unclosed"}]}}`)
+	}))
+	defer server.Close()
+
+	client, err := proxypanel.New(&api.Config{
+		APIHost:  server.URL,
+		Key:      "naBDpLvREiwY9qPr",
+		NodeID:   1,
+		NodeType: "V2ray",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruleList, err := client.GetNodeRule(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]string{1: "", 2: "example.com", 3: "1.1.1.1/32", 4: "10.0.0.0/8"}
+	if len(*ruleList) != len(want) {
+		t.Fatalf("expected the protocol and invalid rules to be skipped, got %+v", *ruleList)
+	}
+	for _, rule := range *ruleList {
+		switch rule.Type {
+		case api.RuleTypeRegexp:
+			if rule.Regexp == nil || !rule.Regexp.MatchString("www.pornhub.com") {
+				t.Errorf("rule %d: expected a compiled regexp, got %+v", rule.ID, rule)
+			}
+		case api.RuleTypeDomain:
+			if rule.Pattern != want[rule.ID] {
+				t.Errorf("rule %d: Pattern = %q, want %q", rule.ID, rule.Pattern, want[rule.ID])
+			}
+		case api.RuleTypeIPCIDR:
+			if rule.IPNet == nil || rule.IPNet.String() != want[rule.ID] {
+				t.Errorf("rule %d: IPNet = %v, want %s", rule.ID, rule.IPNet, want[rule.ID])
+			}
+		}
+	}
+}
+
+func TestOnlineWindow(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		fmt.Fprint(w, `{"status":"success","code":200}`)
+	}))
+	defer server.Close()
+
+	client, err := proxypanel.New(&api.Config{
+		APIHost:      server.URL,
+		Key:          "naBDpLvREiwY9qPr",
+		NodeID:       1,
+		NodeType:     "V2ray",
+		OnlineWindow: 60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		if err := client.ReportNodeOnlineUsers(context.Background(), &[]api.OnlineUser{{UID: 1, IP: ip}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := `[{"uid":1,"ip":"1.1.1.1"},{"uid":1,"ip":"2.2.2.2"}]`; string(body) != want {
+		t.Errorf("expected the IP of the previous poll to be kept, got %s", body)
+	}
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// DefaultMaxRedirects is the number of redirects followed when Config.MaxRedirects is not set
+const DefaultMaxRedirects = 10
+
+// RedirectPolicy returns a resty redirect policy which follows up to maxRedirects redirects of a GET request,
+// 0 for DefaultMaxRedirects and a negative value to never follow. The redirect of a POST is never followed,
+// the report would be sent again or turned into a GET. An unfollowed redirect is returned as the response.
+func RedirectPolicy(maxRedirects int) resty.RedirectPolicy {
+	if maxRedirects == 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+	return resty.RedirectPolicyFunc(func(req *http.Request, via []*http.Request) error {
+		method := via[0].Method
+		if method != http.MethodGet && method != http.MethodHead || len(via) > maxRedirects {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	})
+}
+
+// IsRedirect reports whether the status code is a redirect, 304 Not Modified is not one
+func IsRedirect(statusCode int) bool {
+	return statusCode >= http.StatusMultipleChoices && statusCode < http.StatusBadRequest && statusCode != http.StatusNotModified
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory creates the api client of a panel type from its config
+type Factory func(apiConfig *Config) (API, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a panel type available to New, it is called from the init of each panel package
+// and panics if the name is registered twice or the factory is nil
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("api: Register factory is nil for panel type " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("api: Register called twice for panel type " + name)
+	}
+	registry[name] = factory
+}
+
+// New creates the api client of the registered panel type name
+func New(name string, apiConfig *Config) (API, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupport panel type: %s, supported: %v", name, PanelTypes())
+	}
+	return factory(apiConfig)
+}
+
+// PanelTypes returns the sorted names of the registered panel types
+func PanelTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
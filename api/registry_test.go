@@ -0,0 +1,34 @@
+package api_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// registryRuns gives each run its own panel type, the registry lives for the whole test binary
+var registryRuns int
+
+func TestRegistry(t *testing.T) {
+	registryRuns++
+	name := fmt.Sprintf("TestPanel%d", registryRuns)
+	errCreate := errors.New("bad config")
+	api.Register(name, func(apiConfig *api.Config) (api.API, error) {
+		return nil, errCreate
+	})
+	if _, err := api.New(name, &api.Config{}); !errors.Is(err, errCreate) {
+		t.Errorf("expected the factory error, got %v", err)
+	}
+	if _, err := api.New("NoSuchPanel", &api.Config{}); err == nil {
+		t.Error("expected an error for an unregistered panel type")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a panel type twice to panic")
+		}
+	}()
+	api.Register(name, func(apiConfig *api.Config) (api.API, error) { return nil, nil })
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// DefaultRetryCount is the number of retries when Config.RetryCount is not set
+const DefaultRetryCount = 3
+
+// RetryOnServerError is a resty retry condition which only retries network errors, 429 and 5xx responses,
+// any other 4xx response will not change by sending the same request again.
+func RetryOnServerError(res *resty.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res != nil && (res.StatusCode() >= http.StatusInternalServerError || res.StatusCode() == http.StatusTooManyRequests)
+}
+
+// ParseRetryAfter parses a Retry-After header, either delay seconds or an HTTP date relative to now
+func ParseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(header); err == nil {
+		if sec < 0 {
+			return 0, false
+		}
+		return time.Duration(sec) * time.Second, true
+	}
+	at, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	if wait := at.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// RetryPolicy is the number of retries of each endpoint: node_info, user_list, node_rule and report.
+// An endpoint without an entry uses DefaultRetryPolicy, then the client retry count.
+type RetryPolicy map[string]int
+
+// DefaultRetryPolicy never retries the reports, the panel may have saved a report that failed
+// and a retry would e.g. bill the user traffic twice. Set report in Config.RetryPolicy to override it.
+var DefaultRetryPolicy = RetryPolicy{"report": 0}
+
+type retryEndpointKey struct{}
+
+// WithRetryEndpoint tags the requests made with ctx with the endpoint whose RetryPolicy applies
+func WithRetryEndpoint(ctx context.Context, endpoint string) context.Context {
+	return context.WithValue(ctx, retryEndpointKey{}, endpoint)
+}
+
+// MaxRetryCount returns the retry count the resty client needs for every endpoint to use its own
+func (p RetryPolicy) MaxRetryCount(retryCount int) int {
+	for _, count := range p {
+		if count > retryCount {
+			retryCount = count
+		}
+	}
+	return retryCount
+}
+
+// Condition returns a resty retry condition which applies RetryOnServerError until the endpoint of
+// the request used its retries. An endpoint without an entry in p or DefaultRetryPolicy uses retryCount
+// for a GET or HEAD request, and is never retried otherwise: the panel may have applied a failed POST,
+// a retry would e.g. report the user traffic twice.
+// Resty retries when any condition is true, so it must be the only condition of the client.
+func (p RetryPolicy) Condition(retryCount int) resty.RetryConditionFunc {
+	return func(res *resty.Response, err error) bool {
+		if !RetryOnServerError(res, err) {
+			return false
+		}
+		if res == nil || res.Request == nil {
+			return true
+		}
+		count := retryCount
+		if method := res.Request.Method; method != http.MethodGet && method != http.MethodHead {
+			count = 0
+		}
+		if endpoint, ok := res.Request.Context().Value(retryEndpointKey{}).(string); ok {
+			if c, ok := p[endpoint]; ok {
+				count = c
+			} else if c, ok := DefaultRetryPolicy[endpoint]; ok {
+				count = c
+			}
+		}
+		return res.Request.Attempt <= count
+	}
+}
+
+// HonorRetryAfter returns a resty retry wait function which waits for the Retry-After of a 429 or 503
+// response, and otherwise backs off with up to jitter of random delay, see RetryAfterWithJitter.
+// Resty caps the wait at the client RetryMaxWaitTime, the caller can still back off for the rest of
+// a longer Retry-After through APIError.RetryAfter.
+func HonorRetryAfter(jitter time.Duration) resty.RetryAfterFunc {
+	withJitter := RetryAfterWithJitter(jitter)
+	return func(client *resty.Client, res *resty.Response) (time.Duration, error) {
+		if res != nil && (res.StatusCode() == http.StatusTooManyRequests || res.StatusCode() == http.StatusServiceUnavailable) {
+			if wait, ok := ParseRetryAfter(res.Header().Get("Retry-After"), time.Now()); ok && wait > 0 {
+				return wait, nil
+			}
+		}
+		if jitter <= 0 {
+			// Keep the resty default backoff
+			return 0, nil
+		}
+		return withJitter(client, res)
+	}
+}
+
+// RetryAfterWithJitter returns a resty retry wait function which adds up to jitter of random delay
+// to the exponential backoff, so nodes failing at the same time do not retry at the same time.
+// Resty still caps the total wait at the client RetryMaxWaitTime.
+func RetryAfterWithJitter(jitter time.Duration) resty.RetryAfterFunc {
+	return func(client *resty.Client, res *resty.Response) (time.Duration, error) {
+		attempt := 1
+		if res != nil && res.Request != nil && res.Request.Attempt > 0 {
+			attempt = res.Request.Attempt
+		}
+		wait := client.RetryWaitTime
+		for i := 1; i < attempt && wait < client.RetryMaxWaitTime; i++ {
+			wait *= 2
+		}
+		if wait > client.RetryMaxWaitTime {
+			wait = client.RetryMaxWaitTime
+		}
+		if jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(jitter) + 1))
+		}
+		return wait, nil
+	}
+}
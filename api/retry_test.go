@@ -0,0 +1,110 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/go-resty/resty/v2"
+)
+
+func TestRetryAfterWithJitter(t *testing.T) {
+	client := resty.New().
+		SetRetryWaitTime(100 * time.Millisecond).
+		SetRetryMaxWaitTime(10 * time.Second)
+	jitter := 500 * time.Millisecond
+	retryAfter := api.RetryAfterWithJitter(jitter)
+
+	cases := []struct {
+		attempt int
+		backoff time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+	}
+	for _, c := range cases {
+		waits := make(map[time.Duration]bool)
+		for i := 0; i < 20; i++ {
+			res := &resty.Response{Request: &resty.Request{Attempt: c.attempt}}
+			wait, err := retryAfter(client, res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wait < c.backoff || wait > c.backoff+jitter {
+				t.Errorf("attempt %d: wait %s out of [%s, %s]", c.attempt, wait, c.backoff, c.backoff+jitter)
+			}
+			waits[wait] = true
+		}
+		if len(waits) < 2 {
+			t.Errorf("attempt %d: expected randomized waits, got %v", c.attempt, waits)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		header string
+		wait   time.Duration
+		ok     bool
+	}{
+		{"120", 120 * time.Second, true},
+		{" 0 ", 0, true},
+		{"Mon, 01 Nov 2021 00:00:30 GMT", 30 * time.Second, true},
+		{"Sun, 31 Oct 2021 23:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	}
+	for _, c := range cases {
+		if wait, ok := api.ParseRetryAfter(c.header, now); wait != c.wait || ok != c.ok {
+			t.Errorf("ParseRetryAfter(%q) = %s, %v, want %s, %v", c.header, wait, ok, c.wait, c.ok)
+		}
+	}
+}
+
+func TestHonorRetryAfter(t *testing.T) {
+	client := resty.New()
+	response := func(status int, retryAfter string) *resty.Response {
+		header := make(http.Header)
+		if retryAfter != "" {
+			header.Set("Retry-After", retryAfter)
+		}
+		return &resty.Response{RawResponse: &http.Response{StatusCode: status, Header: header}}
+	}
+	retryAfter := api.HonorRetryAfter(0)
+	if wait, _ := retryAfter(client, response(http.StatusTooManyRequests, "7")); wait != 7*time.Second {
+		t.Errorf("expected the Retry-After of a 429, got %s", wait)
+	}
+	if wait, _ := retryAfter(client, response(http.StatusServiceUnavailable, "3")); wait != 3*time.Second {
+		t.Errorf("expected the Retry-After of a 503, got %s", wait)
+	}
+	// 0 keeps the resty backoff
+	if wait, _ := retryAfter(client, response(http.StatusInternalServerError, "7")); wait != 0 {
+		t.Errorf("expected the Retry-After of a 500 to be ignored, got %s", wait)
+	}
+	if wait, _ := retryAfter(client, response(http.StatusTooManyRequests, "")); wait != 0 {
+		t.Errorf("expected the default backoff without Retry-After, got %s", wait)
+	}
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	failed := func(endpoint string) *resty.Response {
+		req := resty.New().R().SetContext(api.WithRetryEndpoint(context.Background(), endpoint))
+		req.Method = http.MethodGet
+		req.Attempt = 1
+		return &resty.Response{Request: req, RawResponse: &http.Response{StatusCode: http.StatusInternalServerError}}
+	}
+	if api.RetryPolicy(nil).Condition(3)(failed("report"), nil) {
+		t.Error("expected the reports not to be retried by default")
+	}
+	if !api.RetryPolicy(nil).Condition(3)(failed("user_list"), nil) {
+		t.Error("expected the user list to use the client retry count")
+	}
+	if !(api.RetryPolicy{"report": 2}).Condition(3)(failed("report"), nil) {
+		t.Error("expected the RetryPolicy to override the report default")
+	}
+}
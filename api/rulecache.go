@@ -0,0 +1,44 @@
+package api
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// LocalRuleCache caches the parsed local rule list of each file and only reparses it when the file changes
+type LocalRuleCache struct {
+	mu      sync.Mutex
+	entries map[string]localRuleCacheEntry
+}
+
+type localRuleCacheEntry struct {
+	modTime  time.Time
+	ruleList []DetectRule
+}
+
+// Load returns the cached rule list of path, calling read if the file is new or its mtime changed
+func (c *LocalRuleCache) Load(path string, read func(path string) []DetectRule) []DetectRule {
+	if path == "" {
+		return read(path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		// Let read handle and log the error
+		return read(path)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]localRuleCacheEntry)
+	}
+	entry, ok := c.entries[path]
+	if !ok || !entry.modTime.Equal(info.ModTime()) {
+		entry = localRuleCacheEntry{modTime: info.ModTime(), ruleList: read(path)}
+		c.entries[path] = entry
+	}
+	ruleList := make([]DetectRule, len(entry.ruleList))
+	copy(ruleList, entry.ruleList)
+	return ruleList
+}
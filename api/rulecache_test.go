@@ -0,0 +1,41 @@
+package api_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestLocalRuleCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rulelist")
+	if err := os.WriteFile(path, []byte("baidu.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reads := 0
+	read := func(path string) []api.DetectRule {
+		reads++
+		return []api.DetectRule{{ID: -1, Pattern: "baidu.com"}}
+	}
+
+	var cache api.LocalRuleCache
+	cache.Load(path, read)
+	ruleList := cache.Load(path, read)
+	if reads != 1 {
+		t.Errorf("expected the cached rules to be reused, read %d times", reads)
+	}
+	if len(ruleList) != 1 || ruleList[0].Pattern != "baidu.com" {
+		t.Errorf("unexpected rule list: %+v", ruleList)
+	}
+
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	cache.Load(path, read)
+	if reads != 2 {
+		t.Errorf("expected the cache to be invalidated after the mtime changed, read %d times", reads)
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultRuleCacheTTL is how long the rule list is cached when Config.RuleCacheTTL is not set
+const DefaultRuleCacheTTL = 60 * time.Second
+
+// NodeRuleCacheTTL returns the cache TTL of a RuleCacheTTL in sec, 0 for DefaultRuleCacheTTL and negative for disable
+func NodeRuleCacheTTL(sec int) time.Duration {
+	if sec == 0 {
+		return DefaultRuleCacheTTL
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// NodeRuleCache keeps the merged rule list of GetNodeRule for TTL, since the rules rarely change
+type NodeRuleCache struct {
+	TTL      time.Duration // 0 for disable
+	mu       sync.Mutex
+	ruleList []DetectRule
+	expire   time.Time
+}
+
+// Get returns the cached rule list, calling fetch when the cache is empty or expired
+func (c *NodeRuleCache) Get(fetch func() (*[]DetectRule, error)) (*[]DetectRule, error) {
+	if c.TTL <= 0 {
+		return fetch()
+	}
+	// Hold the lock while fetching so concurrent callers share one request
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ruleList == nil || time.Now().After(c.expire) {
+		ruleList, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		c.ruleList = *ruleList
+		c.expire = time.Now().Add(c.TTL)
+	}
+	ruleList := make([]DetectRule, len(c.ruleList))
+	copy(ruleList, c.ruleList)
+	return &ruleList, nil
+}
+
+// Invalidate drops the cached rule list so the next Get fetches it again
+func (c *NodeRuleCache) Invalidate() {
+	c.mu.Lock()
+	c.ruleList = nil
+	c.mu.Unlock()
+}
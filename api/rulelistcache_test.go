@@ -0,0 +1,32 @@
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestNodeRuleCache(t *testing.T) {
+	fetches := 0
+	fetch := func() (*[]api.DetectRule, error) {
+		fetches++
+		return &[]api.DetectRule{{ID: 1, Pattern: "google.com"}}, nil
+	}
+	cache := &api.NodeRuleCache{TTL: 50 * time.Millisecond}
+	cache.Get(fetch)
+	cache.Get(fetch)
+	if fetches != 1 {
+		t.Errorf("expected one fetch within the TTL, got %d", fetches)
+	}
+	time.Sleep(60 * time.Millisecond)
+	cache.Get(fetch)
+	if fetches != 2 {
+		t.Errorf("expected a fetch after the TTL expired, got %d", fetches)
+	}
+	cache.Invalidate()
+	cache.Get(fetch)
+	if fetches != 3 {
+		t.Errorf("expected a fetch after Invalidate, got %d", fetches)
+	}
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// RuleType tells how the Pattern of a DetectRule is compared with the destination
+type RuleType string
+
+const (
+	RuleTypeRegexp RuleType = "regexp"  // Pattern is a regex matched against the whole destination, the default
+	RuleTypeDomain RuleType = "domain"  // Pattern is a domain, matching itself and its subdomains
+	RuleTypeIPCIDR RuleType = "ip-cidr" // Pattern is an IP CIDR matching the destination IP
+)
+
+// ParseRuleType returns the rule type named by a panel or a local rule prefix, an empty name is a regexp.
+// The aliases used by the panels are accepted, e.g. "reg" and "ip" of Proxypanel.
+func ParseRuleType(name string) (ruleType RuleType, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "regexp", "regex", "reg":
+		return RuleTypeRegexp, true
+	case "domain":
+		return RuleTypeDomain, true
+	case "ip-cidr", "ip", "cidr":
+		return RuleTypeIPCIDR, true
+	default:
+		return "", false
+	}
+}
+
+// SplitRuleType splits a typed pattern like "ip-cidr:10.0.0.0/8" into its type and pattern.
+// A pattern without a known type prefix is a regexp and is returned unchanged.
+func SplitRuleType(typedPattern string) (RuleType, string) {
+	if i := strings.Index(typedPattern, ":"); i > 0 {
+		if ruleType, ok := ParseRuleType(typedPattern[:i]); ok {
+			return ruleType, strings.TrimSpace(typedPattern[i+1:])
+		}
+	}
+	return RuleTypeRegexp, typedPattern
+}
+
+// NewDetectRule validates the pattern of a rule and compiles it for its type,
+// so it is matched without parsing it again for every connection
+func NewDetectRule(id int, ruleType RuleType, pattern string) (DetectRule, error) {
+	rule := DetectRule{ID: id, Type: ruleType, Pattern: pattern}
+	switch ruleType {
+	case RuleTypeRegexp, "":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return rule, err
+		}
+		rule.Regexp = re
+	case RuleTypeDomain:
+		rule.Pattern = strings.ToLower(strings.Trim(pattern, "."))
+		if rule.Pattern == "" {
+			return rule, fmt.Errorf("empty domain")
+		}
+	case RuleTypeIPCIDR:
+		ipNet, err := ParseIPCIDR(pattern)
+		if err != nil {
+			return rule, err
+		}
+		rule.IPNet = ipNet
+	default:
+		return rule, fmt.Errorf("unknown rule type: %s", ruleType)
+	}
+	return rule, nil
+}
+
+// ParseIPCIDR parses the pattern of an ip-cidr rule, a bare IP is a /32 or /128 CIDR
+func ParseIPCIDR(pattern string) (*net.IPNet, error) {
+	if ip := net.ParseIP(pattern); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(pattern)
+	return ipNet, err
+}
@@ -0,0 +1,60 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestSplitRuleType(t *testing.T) {
+	cases := []struct {
+		typedPattern string
+		ruleType     api.RuleType
+		pattern      string
+	}{
+		{"baidu.com", api.RuleTypeRegexp, "baidu.com"},
+		{"regexp:(.+\\.|^)qq\\.com", api.RuleTypeRegexp, "(.+\\.|^)qq\\.com"},
+		{"domain:example.com", api.RuleTypeDomain, "example.com"},
+		{"ip-cidr:10.0.0.0/8", api.RuleTypeIPCIDR, "10.0.0.0/8"},
+		{"full:example.com", api.RuleTypeRegexp, "full:example.com"},
+		{":443", api.RuleTypeRegexp, ":443"},
+	}
+	for _, c := range cases {
+		ruleType, pattern := api.SplitRuleType(c.typedPattern)
+		if ruleType != c.ruleType || pattern != c.pattern {
+			t.Errorf("SplitRuleType(%q) = %s, %q, want %s, %q", c.typedPattern, ruleType, pattern, c.ruleType, c.pattern)
+		}
+	}
+}
+
+func TestNewDetectRule(t *testing.T) {
+	rule, err := api.NewDetectRule(1, api.RuleTypeIPCIDR, "10.0.0.0/8")
+	if err != nil || rule.IPNet == nil || rule.IPNet.String() != "10.0.0.0/8" {
+		t.Errorf("expected the CIDR to be parsed, got %+v, %v", rule, err)
+	}
+	rule, err = api.NewDetectRule(2, api.RuleTypeDomain, ".Example.com")
+	if err != nil || rule.Pattern != "example.com" {
+		t.Errorf("expected the domain to be normalized, got %+v, %v", rule, err)
+	}
+	for ruleType, pattern := range map[api.RuleType]string{
+		api.RuleTypeRegexp: "(unclosed",
+		api.RuleTypeDomain: ".",
+		api.RuleTypeIPCIDR: "10.0.0.1/33",
+	} {
+		if _, err := api.NewDetectRule(3, ruleType, pattern); err == nil {
+			t.Errorf("expected the %s rule %q to be rejected", ruleType, pattern)
+		}
+	}
+}
+
+func TestBareIPRule(t *testing.T) {
+	for pattern, cidr := range map[string]string{
+		"10.0.0.1":    "10.0.0.1/32",
+		"2001:db8::1": "2001:db8::1/128",
+	} {
+		rule, err := api.NewDetectRule(1, api.RuleTypeIPCIDR, pattern)
+		if err != nil || rule.IPNet == nil || rule.IPNet.String() != cidr {
+			t.Errorf("expected %s to be parsed as %s, got %+v, %v", pattern, cidr, rule, err)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// CheckHeadEndpoint probes an endpoint with a HEAD request, so no data is posted and no large user list is downloaded.
+// Report endpoints usually only accept POST, so 405 Method Not Allowed still proves the endpoint exists.
+func CheckHeadEndpoint(req *resty.Request, path string) error {
+	res, err := req.Head(path)
+	if err != nil {
+		return fmt.Errorf("request %s failed: %s", path, err)
+	}
+	if res.StatusCode() >= 400 && res.StatusCode() != http.StatusMethodNotAllowed {
+		return fmt.Errorf("request %s failed: %s", path, res.Status())
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+//go:build go1.18
+// +build go1.18
+
+package sspanel_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/api/sspanel"
+)
+
+// fuzzTransport answers every request with the same status and body
+type fuzzTransport struct {
+	status int
+	body   []byte
+}
+
+func (t *fuzzTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: t.status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(t.body)),
+		Request:    req,
+	}, nil
+}
+
+func createFuzzClient(nodeType string, status int, body []byte) api.API {
+	apiConfig := &api.Config{
+		APIHost:   "http://fuzz.panel",
+		Key:       "123",
+		NodeID:    1,
+		NodeType:  nodeType,
+		Transport: &fuzzTransport{status: status, body: body},
+		// Keep the retries of a 5xx body fast
+		RetryWaitTime: 1,
+	}
+	client, err := sspanel.New(apiConfig)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+func FuzzParseResponse(f *testing.F) {
+	f.Add(200, []byte(`{"ret":1,"data":[]}`))
+	f.Add(200, []byte(`{"ret":0,"data":"error"}`))
+	f.Add(500, []byte(`Internal Server Error`))
+	f.Add(200, []byte(`null`))
+	f.Fuzz(func(t *testing.T, status int, body []byte) {
+		if status < 100 || status > 999 {
+			return
+		}
+		client := createFuzzClient("V2ray", status, body)
+		client.ReportNodeStatus(context.Background(), &api.NodeStatus{CPU: 1, Mem: 1, Disk: 1, Uptime: 256})
+		client.GetUserList(context.Background())
+		client.GetNodeRule(context.Background())
+	})
+}
+
+func FuzzGetNodeInfoParse(f *testing.F) {
+	f.Add("V2ray", []byte(`{"ret":1,"data":{"server":"v2.example.com;10086;0;ws;tls;path=/v2ray|host=v2.example.com"}}`))
+	f.Add("Trojan", []byte(`{"ret":1,"data":{"server":"gz.example.com;port=443#12345|host=hk.example.com"}}`))
+	f.Add("Shadowsocks-Plugin", []byte(`{"ret":1,"data":{"server":"ss.example.com;10087;0;ws;tls;path=/ss"}}`))
+	f.Add("V2ray", []byte(`{"ret":1,"data":{"version":"2021.11","custom_config":{"offset_port_node":"443","alter_id":"0"}}}`))
+	f.Fuzz(func(t *testing.T, nodeType string, body []byte) {
+		createFuzzClient(nodeType, http.StatusOK, body).GetNodeInfo(context.Background())
+	})
+}
@@ -0,0 +1,149 @@
+package sspanel_test
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// Run `go test -run TestGolden -golden.record -golden.host http://panel -golden.key xxx`
+// to refresh the golden files from a real panel.
+var (
+	goldenRecord = flag.Bool("golden.record", false, "record the golden files from a real panel")
+	goldenHost   = flag.String("golden.host", "http://127.0.0.1:667", "panel used when recording")
+	goldenKey    = flag.String("golden.key", "123", "panel key used when recording")
+)
+
+// goldenFile maps a request to its golden file, e.g. GET /mod_mu/users -> GET_mod_mu_users.json
+func goldenFile(dir string, req *http.Request) string {
+	name := req.Method + strings.ReplaceAll(req.URL.Path, "/", "_") + ".json"
+	return filepath.Join(dir, name)
+}
+
+// replayTransport answers every request with the recorded golden file
+type replayTransport struct {
+	dir string
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := http.StatusOK
+	body, err := os.ReadFile(goldenFile(t.dir, req))
+	if err != nil {
+		status = http.StatusNotFound
+		body = []byte(fmt.Sprintf("no golden file for %s %s", req.Method, req.URL.Path))
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// recordTransport forwards the requests to a real panel and saves the responses
+type recordTransport struct {
+	dir string
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(goldenFile(t.dir, req), body, 0644); err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+func TestGolden(t *testing.T) {
+	cases := []struct {
+		nodeType string
+		nodeID   int
+		dir      string
+	}{
+		{"V2ray", 3, "v2ray"},
+		{"Trojan", 72, "trojan"},
+		{"Shadowsocks", 64, "shadowsocks"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.nodeType, func(t *testing.T) {
+			dir := filepath.Join("testdata", "golden", tc.dir)
+			apiConfig := &api.Config{
+				APIHost:   "http://golden.panel",
+				Key:       "123",
+				NodeID:    tc.nodeID,
+				NodeType:  tc.nodeType,
+				Transport: &replayTransport{dir: dir},
+			}
+			if *goldenRecord {
+				apiConfig.APIHost = *goldenHost
+				apiConfig.Key = *goldenKey
+				apiConfig.Transport = &recordTransport{dir: dir}
+			}
+			assertGolden(t, newClient(t, apiConfig))
+		})
+	}
+}
+
+// assertGolden calls every API method and fails on any parsing error
+func assertGolden(t *testing.T, client api.API) {
+	nodeInfo, err := client.GetNodeInfo(context.Background())
+	if err != nil {
+		t.Fatalf("GetNodeInfo: %s", err)
+	}
+	if nodeInfo.Port == 0 {
+		t.Errorf("GetNodeInfo: no port parsed from %+v", nodeInfo)
+	}
+
+	userList, err := client.GetUserList(context.Background())
+	if err != nil {
+		t.Fatalf("GetUserList: %s", err)
+	}
+	if len(*userList) == 0 {
+		t.Error("GetUserList: no user parsed")
+	}
+
+	if err := client.ReportNodeStatus(context.Background(), &api.NodeStatus{CPU: 1, Mem: 1, Disk: 1, Uptime: 256}); err != nil {
+		t.Errorf("ReportNodeStatus: %s", err)
+	}
+
+	onlineUserList := []api.OnlineUser{{UID: (*userList)[0].UID, IP: "1.1.1.1"}}
+	if err := client.ReportNodeOnlineUsers(context.Background(), &onlineUserList); err != nil {
+		t.Errorf("ReportNodeOnlineUsers: %s", err)
+	}
+
+	userTraffic := []api.UserTraffic{{UID: (*userList)[0].UID, Upload: 114514, Download: 114514}}
+	if err := client.ReportUserTraffic(context.Background(), &userTraffic); err != nil {
+		t.Errorf("ReportUserTraffic: %s", err)
+	}
+
+	ruleList, err := client.GetNodeRule(context.Background())
+	if err != nil {
+		t.Fatalf("GetNodeRule: %s", err)
+	}
+	if len(*ruleList) == 0 {
+		t.Error("GetNodeRule: no rule parsed")
+	}
+
+	detectResult := []api.DetectResult{{UID: (*userList)[0].UID, RuleID: (*ruleList)[0].ID}}
+	if err := client.ReportIllegal(context.Background(), &detectResult); err != nil {
+		t.Errorf("ReportIllegal: %s", err)
+	}
+}
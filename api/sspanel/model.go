@@ -77,8 +77,9 @@ type PostData struct {
 
 // SystemLoad is the data structure of systemload
 type SystemLoad struct {
-	Uptime string `json:"uptime"`
-	Load   string `json:"load"`
+	Uptime  string  `json:"uptime"`
+	Load    string  `json:"load"`
+	CPUTemp float64 `json:"cpu_temp,omitempty"`
 }
 
 // OnlineUser is the data structure of online user
@@ -97,6 +98,7 @@ type UserTraffic struct {
 type RuleItem struct {
 	ID      int    `json:"id"`
 	Content string `json:"regex"`
+	Type    string `json:"rule_type"` // Optional, see api.ParseRuleType
 }
 
 type IllegalItem struct {
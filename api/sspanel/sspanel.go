@@ -1,11 +1,10 @@
 package sspanel
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -28,6 +27,7 @@ var (
 
 // APIClient create a api client to the panel.
 type APIClient struct {
+	*api.ClientBase
 	client           *resty.Client
 	APIHost          string
 	NodeID           int
@@ -37,84 +37,64 @@ type APIClient struct {
 	EnableXTLS       bool
 	SpeedLimit       float64
 	DeviceLimit      int
-	LocalRuleList    []api.DetectRule
+	DryRun           bool
+	DefaultTransport string
+	TrafficBatchSize int
+	userListGuard    api.UserListGuard
+	illegalDedup     api.IllegalReportDedup
+	onlineTracker    api.OnlineTracker
+	nodeInfoCache    api.NodeInfoCache
+	ipHasher         *api.IPHasher
 	LastReportOnline map[int]int
 	access           sync.Mutex
 }
 
+func init() {
+	api.Register("SSpanel", func(apiConfig *api.Config) (api.API, error) {
+		apiClient, err := New(apiConfig)
+		if err != nil {
+			return nil, err
+		}
+		return apiClient, nil
+	})
+}
+
 // New creat a api instance
-func New(apiConfig *api.Config) *APIClient {
+func New(apiConfig *api.Config) (*APIClient, error) {
 
-	client := resty.New()
-	client.SetRetryCount(3)
-	if apiConfig.Timeout > 0 {
-		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
-	} else {
-		client.SetTimeout(5 * time.Second)
+	ipHasher, err := api.NewIPHasher(apiConfig)
+	if err != nil {
+		return nil, err
+	}
+	client, apiHost, err := api.NewRestyClient(apiConfig)
+	if err != nil {
+		return nil, err
 	}
-	client.OnError(func(req *resty.Request, err error) {
-		if v, ok := err.(*resty.ResponseError); ok {
-			// v.Response contains the last response from the server
-			// v.Err contains the original error
-			log.Print(v.Err)
-		}
-	})
-	client.SetHostURL(apiConfig.APIHost)
 	// Create Key for each requests
 	client.SetQueryParam("key", apiConfig.Key)
 	// Add support for muKey
 	client.SetQueryParam("muKey", apiConfig.Key)
-	// Read local rule list
-	localRuleList := readLocalRuleList(apiConfig.RuleListPath)
 
 	return &APIClient{
+		ClientBase:       api.NewClientBase(apiConfig, client, apiHost),
 		client:           client,
 		NodeID:           apiConfig.NodeID,
 		Key:              apiConfig.Key,
-		APIHost:          apiConfig.APIHost,
+		APIHost:          apiHost,
 		NodeType:         apiConfig.NodeType,
 		EnableVless:      apiConfig.EnableVless,
 		EnableXTLS:       apiConfig.EnableXTLS,
 		SpeedLimit:       apiConfig.SpeedLimit,
 		DeviceLimit:      apiConfig.DeviceLimit,
-		LocalRuleList:    localRuleList,
+		DryRun:           apiConfig.DryRun,
+		DefaultTransport: api.DefaultTransportOf(apiConfig),
+		TrafficBatchSize: apiConfig.TrafficBatchSize,
+		userListGuard:    api.UserListGuard{RejectEmpty: apiConfig.RejectEmptyUserList},
+		onlineTracker:    api.OnlineTracker{Window: time.Duration(apiConfig.OnlineWindow) * time.Second},
+		illegalDedup:     api.IllegalReportDedup{Cooldown: api.IllegalReportCooldown(apiConfig.IllegalCooldown)},
+		ipHasher:         ipHasher,
 		LastReportOnline: make(map[int]int),
-	}
-}
-
-// readLocalRuleList reads the local rule list file
-func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
-
-	LocalRuleList = make([]api.DetectRule, 0)
-	if path != "" {
-		// open the file
-		file, err := os.Open(path)
-
-		//handle errors while opening
-		if err != nil {
-			log.Printf("Error when opening file: %s", err)
-			return LocalRuleList
-		}
-
-		fileScanner := bufio.NewScanner(file)
-
-		// read line by line
-		for fileScanner.Scan() {
-			LocalRuleList = append(LocalRuleList, api.DetectRule{
-				ID:      -1,
-				Pattern: fileScanner.Text(),
-			})
-		}
-		// handle first encountered error while reading
-		if err := fileScanner.Err(); err != nil {
-			log.Fatalf("Error while reading file: %s", err)
-			return make([]api.DetectRule, 0)
-		}
-
-		file.Close()
-	}
-
-	return LocalRuleList
+	}, nil
 }
 
 // Describe return a description of the client
@@ -127,36 +107,97 @@ func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
 }
 
+// Ping fetches /mod_mu/nodes/{NodeID}/info and checks it carries node info data
+func (c *APIClient) Ping(ctx context.Context) error {
+	ctx = api.WithRetryEndpoint(ctx, "node_info")
+	path := fmt.Sprintf("/mod_mu/nodes/%d/info", c.NodeID)
+	res, err := c.client.R().SetContext(ctx).
+		SetResult(&Response{}).
+		ForceContentType("application/json").
+		Get(path)
+	response, err := c.parseResponse(res, path, err)
+	if err != nil {
+		return err
+	}
+	return api.CheckNodeInfoData(response.Data)
+}
+
+// SelfTest fetches the node info and detect rules, and probes the users and the four report endpoints by HEAD
+func (c *APIClient) SelfTest(ctx context.Context) map[string]error {
+	result := make(map[string]error)
+	for name, path := range map[string]string{
+		"node_info": fmt.Sprintf("/mod_mu/nodes/%d/info", c.NodeID),
+		"node_rule": "/mod_mu/func/detect_rules",
+	} {
+		res, err := c.client.R().SetContext(ctx).
+			SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
+			SetResult(&Response{}).
+			ForceContentType("application/json").
+			Get(path)
+		_, result[name] = c.parseResponse(res, path, err)
+	}
+	for name, path := range map[string]string{
+		"user_list":    "/mod_mu/users",
+		"node_status":  fmt.Sprintf("/mod_mu/nodes/%d/info", c.NodeID),
+		"online_users": "/mod_mu/users/aliveip",
+		"user_traffic": "/mod_mu/users/traffic",
+		"illegal":      "/mod_mu/users/detectlog",
+	} {
+		result[name] = api.CheckHeadEndpoint(c.client.R().SetContext(ctx).SetQueryParam("node_id", strconv.Itoa(c.NodeID)), path)
+	}
+	return result
+}
+
 func (c *APIClient) assembleURL(path string) string {
 	return c.APIHost + path
 }
 
 func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (*Response, error) {
 	if err != nil {
-		return nil, fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)
+		statusCode := 0
+		if res != nil {
+			statusCode = res.StatusCode()
+		}
+		return nil, api.NewRequestError(c.assembleURL(path), statusCode, err)
 	}
 
+	if api.IsRedirect(res.StatusCode()) {
+		return nil, &api.APIError{Kind: api.HTTPError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: "redirect to " + res.Header().Get("Location") + " not followed"}
+	}
+	if rateLimitErr := api.NewRateLimitError(c.assembleURL(path), res); rateLimitErr != nil {
+		return nil, rateLimitErr
+	}
 	if res.StatusCode() > 400 {
 		body := res.Body()
-		return nil, fmt.Errorf("request %s failed: %s, %s", c.assembleURL(path), string(body), err)
+		return nil, &api.APIError{Kind: api.HTTPError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: string(body)}
 	}
 	response := res.Result().(*Response)
 
 	if response.Ret != 1 {
-		res, _ := json.Marshal(&response)
-		return nil, fmt.Errorf("Ret %s invalid", string(res))
+		body, _ := json.Marshal(&response)
+		return nil, &api.APIError{Kind: api.PanelError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: string(body)}
 	}
 	return response, nil
 }
 
 // GetNodeInfo will pull NodeInfo Config from sspanel
-func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
+func (c *APIClient) GetNodeInfo(ctx context.Context) (nodeInfo *api.NodeInfo, err error) {
+	defer c.Emitter.Poll("node_info", &err)
+	ctx = api.WithRetryEndpoint(ctx, "node_info")
 	path := fmt.Sprintf("/mod_mu/nodes/%d/info", c.NodeID)
-	res, err := c.client.R().
+	req := c.client.R().SetContext(ctx)
+	// The port and method of a Shadowsocks node come from the user list, a 304 would keep them stale
+	if c.NodeType != "Shadowsocks" {
+		req = c.nodeInfoCache.SetIfNoneMatch(req)
+	}
+	res, err := req.
 		SetResult(&Response{}).
 		ForceContentType("application/json").
 		Get(path)
 
+	if cached, ok := c.nodeInfoCache.NotModified(res); ok && err == nil {
+		return cached, api.ErrNodeInfoNotModified
+	}
 	response, err := c.parseResponse(res, path, err)
 	if err != nil {
 		return nil, err
@@ -178,7 +219,7 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 		case "Trojan":
 			nodeInfo, err = c.ParseTrojanNodeResponse(nodeInfoResponse)
 		case "Shadowsocks":
-			nodeInfo, err = c.ParseSSNodeResponse(nodeInfoResponse)
+			nodeInfo, err = c.ParseSSNodeResponse(ctx, nodeInfoResponse)
 		case "Shadowsocks-Plugin":
 			nodeInfo, err = c.ParseSSPluginNodeResponse(nodeInfoResponse)
 		default:
@@ -191,13 +232,19 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 		return nil, fmt.Errorf("Parse node info failed: %s", string(res))
 	}
 
+	c.Metrics.RecordResponse(c.client, "node_info", res)
+	api.FinishNodeInfo(nodeInfo, c.DefaultTransport)
+	c.nodeInfoCache.Store(res, nodeInfo)
+	c.Emitter.NodeInfo(nodeInfo)
 	return nodeInfo, nil
 }
 
 // GetUserList will pull user form sspanel
-func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
+func (c *APIClient) GetUserList(ctx context.Context) (UserList *[]api.UserInfo, err error) {
+	defer c.Emitter.Poll("user_list", &err)
+	ctx = api.WithRetryEndpoint(ctx, "user_list")
 	path := "/mod_mu/users"
-	res, err := c.client.R().
+	res, err := c.client.R().SetContext(ctx).
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
@@ -218,18 +265,24 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 		res, _ := json.Marshal(userListResponse)
 		return nil, fmt.Errorf("Parse user list failed: %s", string(res))
 	}
+	if err := c.userListGuard.Check(userList); err != nil {
+		return nil, err
+	}
+	c.Metrics.RecordUserList(c.client, res, len(*userList))
 	return userList, nil
 }
 
 // ReportNodeStatus reports the node status to the sspanel
-func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
+func (c *APIClient) ReportNodeStatus(ctx context.Context, nodeStatus *api.NodeStatus) (err error) {
+	ctx = api.WithRetryEndpoint(ctx, "report")
 	path := fmt.Sprintf("/mod_mu/nodes/%d/info", c.NodeID)
 	systemload := SystemLoad{
-		Uptime: strconv.Itoa(nodeStatus.Uptime),
-		Load:   fmt.Sprintf("%.2f %.2f %.2f", nodeStatus.CPU/100, nodeStatus.CPU/100, nodeStatus.CPU/100),
+		Uptime:  strconv.Itoa(nodeStatus.Uptime),
+		Load:    fmt.Sprintf("%.2f %.2f %.2f", nodeStatus.CPU/100, nodeStatus.CPU/100, nodeStatus.CPU/100),
+		CPUTemp: api.CPUTemp(&c.Config, nodeStatus),
 	}
 
-	res, err := c.client.R().
+	res, err := c.client.R().SetContext(ctx).
 		SetBody(systemload).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
@@ -244,14 +297,19 @@ func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
 }
 
 //ReportNodeOnlineUsers reports online user ip
-func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) error {
+func (c *APIClient) ReportNodeOnlineUsers(ctx context.Context, onlineUserList *[]api.OnlineUser) error {
+	ctx = api.WithRetryEndpoint(ctx, "report")
 	c.access.Lock()
 	defer c.access.Unlock()
 
 	reportOnline := make(map[int]int)
-	data := make([]OnlineUser, len(*onlineUserList))
-	for i, user := range *onlineUserList {
-		data[i] = OnlineUser{UID: user.UID, IP: user.IP}
+	onlineUsers := c.onlineTracker.Track(*onlineUserList)
+	if len(onlineUsers) == 0 {
+		return nil
+	}
+	data := make([]OnlineUser, len(onlineUsers))
+	for i, user := range onlineUsers {
+		data[i] = OnlineUser{UID: user.UID, IP: c.ipHasher.Hash(user.IP)}
 		if _, ok := reportOnline[user.UID]; ok {
 			reportOnline[user.UID]++
 		} else {
@@ -262,7 +320,11 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 
 	postData := &PostData{Data: data}
 	path := fmt.Sprintf("/mod_mu/users/aliveip")
-	res, err := c.client.R().
+	if c.DryRun {
+		api.LogDryRun(path, postData)
+		return nil
+	}
+	res, err := c.client.R().SetContext(ctx).
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
 		SetBody(postData).
 		SetResult(&Response{}).
@@ -278,10 +340,15 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 }
 
 // ReportUserTraffic reports the user traffic
-func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
+func (c *APIClient) ReportUserTraffic(ctx context.Context, userTraffic *[]api.UserTraffic) error {
+	return api.ReportInBatches(api.WithRetryEndpoint(ctx, "report"), *userTraffic, c.TrafficBatchSize, c.reportUserTraffic)
+}
 
-	data := make([]UserTraffic, len(*userTraffic))
-	for i, traffic := range *userTraffic {
+// reportUserTraffic reports a single batch of user traffic
+func (c *APIClient) reportUserTraffic(ctx context.Context, userTraffic []api.UserTraffic) error {
+
+	data := make([]UserTraffic, len(userTraffic))
+	for i, traffic := range userTraffic {
 		data[i] = UserTraffic{
 			UID:      traffic.UID,
 			Upload:   traffic.Upload,
@@ -289,7 +356,11 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 	}
 	postData := &PostData{Data: data}
 	path := "/mod_mu/users/traffic"
-	res, err := c.client.R().
+	if c.DryRun {
+		api.LogDryRun(path, postData)
+		return nil
+	}
+	res, err := c.client.R().SetContext(ctx).
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
 		SetBody(postData).
 		SetResult(&Response{}).
@@ -304,10 +375,19 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 }
 
 // GetNodeRule will pull the audit rule form sspanel
-func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
-	ruleList := c.LocalRuleList
+func (c *APIClient) GetNodeRule(ctx context.Context) (ruleList *[]api.DetectRule, err error) {
+	defer c.Emitter.Poll("node_rule", &err)
+	ctx = api.WithRetryEndpoint(ctx, "node_rule")
+	return c.RuleCache.Get(func() (*[]api.DetectRule, error) {
+		return c.getNodeRule(ctx)
+	})
+}
+
+// getNodeRule fetches the rule list bypassing the cache
+func (c *APIClient) getNodeRule(ctx context.Context) (*[]api.DetectRule, error) {
+	ruleList := api.LocalRules(&c.Config)
 	path := "/mod_mu/func/detect_rules"
-	res, err := c.client.R().
+	res, err := c.client.R().SetContext(ctx).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
 		Get(path)
@@ -324,19 +404,32 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	}
 
 	for _, r := range *ruleListResponse {
-		ruleList = append(ruleList, api.DetectRule{
-			ID:      r.ID,
-			Pattern: r.Content,
-		})
+		ruleType, ok := api.ParseRuleType(r.Type)
+		if !ok {
+			log.Printf("Skip the rule %d of unsupported type %s", r.ID, r.Type)
+			continue
+		}
+		rule, err := api.NewDetectRule(r.ID, ruleType, r.Content)
+		if err != nil {
+			log.Printf("Skip the invalid rule %d: %s", r.ID, err)
+			continue
+		}
+		ruleList = append(ruleList, rule)
 	}
 	return &ruleList, nil
 }
 
 // ReportIllegal reports the user illegal behaviors
-func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
+func (c *APIClient) ReportIllegal(ctx context.Context, detectResultList *[]api.DetectResult) error {
+	c.Emitter.RuleHit(*detectResultList)
+	ctx = api.WithRetryEndpoint(ctx, "report")
+	detectResults := c.illegalDedup.Filter(api.PanelDetectResults(*detectResultList))
+	if len(detectResults) == 0 {
+		return nil
+	}
 
-	data := make([]IllegalItem, len(*detectResultList))
-	for i, r := range *detectResultList {
+	data := make([]IllegalItem, len(detectResults))
+	for i, r := range detectResults {
 		data[i] = IllegalItem{
 			ID:  r.RuleID,
 			UID: r.UID,
@@ -344,7 +437,11 @@ func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
 	}
 	postData := &PostData{Data: data}
 	path := "/mod_mu/users/detectlog"
-	res, err := c.client.R().
+	if c.DryRun {
+		api.LogDryRun(path, postData)
+		return nil
+	}
+	res, err := c.client.R().SetContext(ctx).
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
 		SetBody(postData).
 		SetResult(&Response{}).
@@ -354,6 +451,7 @@ func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
 	if err != nil {
 		return err
 	}
+	c.illegalDedup.Reported(detectResults...)
 	return nil
 }
 
@@ -368,6 +466,9 @@ func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *NodeInfoResponse) (
 	}
 	//nodeInfo.RawServerString = strings.ToLower(nodeInfo.RawServerString)
 	serverConf := strings.Split(nodeInfoResponse.RawServerString, ";")
+	if len(serverConf) < 6 {
+		return nil, fmt.Errorf("Server string %s is incomplete", nodeInfoResponse.RawServerString)
+	}
 	port, err := strconv.Atoi(serverConf[1])
 	if err != nil {
 		return nil, err
@@ -397,7 +498,7 @@ func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *NodeInfoResponse) (
 	for _, item := range extraServerConf {
 		conf := strings.Split(item, "=")
 		key := conf[0]
-		if key == "" {
+		if key == "" || len(conf) < 2 {
 			continue
 		}
 		value := conf[1]
@@ -449,12 +550,12 @@ func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *NodeInfoResponse) (
 }
 
 // ParseSSNodeResponse parse the response for the given nodeinfor format
-func (c *APIClient) ParseSSNodeResponse(nodeInfoResponse *NodeInfoResponse) (*api.NodeInfo, error) {
+func (c *APIClient) ParseSSNodeResponse(ctx context.Context, nodeInfoResponse *NodeInfoResponse) (*api.NodeInfo, error) {
 	var port int = 0
 	var speedlimit uint64 = 0
 	var method string
 	path := "/mod_mu/users"
-	res, err := c.client.R().
+	res, err := c.client.R().SetContext(ctx).
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
@@ -507,6 +608,9 @@ func (c *APIClient) ParseSSPluginNodeResponse(nodeInfoResponse *NodeInfoResponse
 	var speedlimit uint64 = 0
 
 	serverConf := strings.Split(nodeInfoResponse.RawServerString, ";")
+	if len(serverConf) < 6 {
+		return nil, fmt.Errorf("Server string %s is incomplete", nodeInfoResponse.RawServerString)
+	}
 	port, err := strconv.Atoi(serverConf[1])
 	if err != nil {
 		return nil, err
@@ -536,7 +640,7 @@ func (c *APIClient) ParseSSPluginNodeResponse(nodeInfoResponse *NodeInfoResponse
 	for _, item := range extraServerConf {
 		conf := strings.Split(item, "=")
 		key := conf[0]
-		if key == "" {
+		if key == "" || len(conf) < 2 {
 			continue
 		}
 		value := conf[1]
@@ -607,13 +711,16 @@ func (c *APIClient) ParseTrojanNodeResponse(nodeInfoResponse *NodeInfoResponse)
 	}
 
 	serverConf := strings.Split(nodeInfoResponse.RawServerString, ";")
+	if len(serverConf) < 2 {
+		return nil, fmt.Errorf("Server string %s is incomplete", nodeInfoResponse.RawServerString)
+	}
 	extraServerConf := strings.Split(serverConf[1], "|")
 	transportProtocol = "tcp"
 	serviceName = ""
 	for _, item := range extraServerConf {
 		conf := strings.Split(item, "=")
 		key := conf[0]
-		if key == "" {
+		if key == "" || len(conf) < 2 {
 			continue
 		}
 		value := conf[1]
@@ -1,8 +1,26 @@
 package sspanel_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/XrayR-project/XrayR/api"
 	"github.com/XrayR-project/XrayR/api/sspanel"
@@ -15,14 +33,27 @@ func CreateClient() api.API {
 		NodeID:   3,
 		NodeType: "V2ray",
 	}
-	client := sspanel.New(apiConfig)
+	client, err := sspanel.New(apiConfig)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// newClient creates a client from apiConfig, failing the test on a config error
+func newClient(t *testing.T, apiConfig *api.Config) *sspanel.APIClient {
+	t.Helper()
+	client, err := sspanel.New(apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
 	return client
 }
 
 func TestGetV2rayNodeinfo(t *testing.T) {
 	client := CreateClient()
 
-	nodeInfo, err := client.GetNodeInfo()
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -36,8 +67,8 @@ func TestGetSSNodeinfo(t *testing.T) {
 		NodeID:   64,
 		NodeType: "Shadowsocks",
 	}
-	client := sspanel.New(apiConfig)
-	nodeInfo, err := client.GetNodeInfo()
+	client := newClient(t, apiConfig)
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -51,8 +82,8 @@ func TestGetTrojanNodeinfo(t *testing.T) {
 		NodeID:   72,
 		NodeType: "Trojan",
 	}
-	client := sspanel.New(apiConfig)
-	nodeInfo, err := client.GetNodeInfo()
+	client := newClient(t, apiConfig)
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -62,7 +93,7 @@ func TestGetTrojanNodeinfo(t *testing.T) {
 func TestGetSSinfo(t *testing.T) {
 	client := CreateClient()
 
-	nodeInfo, err := client.GetNodeInfo()
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -72,7 +103,7 @@ func TestGetSSinfo(t *testing.T) {
 func TestGetUserList(t *testing.T) {
 	client := CreateClient()
 
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -83,9 +114,9 @@ func TestGetUserList(t *testing.T) {
 func TestReportNodeStatus(t *testing.T) {
 	client := CreateClient()
 	nodeStatus := &api.NodeStatus{
-		1, 1, 1, 256,
+		CPU: 1, Mem: 1, Disk: 1, Uptime: 256,
 	}
-	err := client.ReportNodeStatus(nodeStatus)
+	err := client.ReportNodeStatus(context.Background(), nodeStatus)
 	if err != nil {
 		t.Error(err)
 	}
@@ -93,7 +124,7 @@ func TestReportNodeStatus(t *testing.T) {
 
 func TestReportReportNodeOnlineUsers(t *testing.T) {
 	client := CreateClient()
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -106,7 +137,7 @@ func TestReportReportNodeOnlineUsers(t *testing.T) {
 		}
 	}
 	//client.Debug()
-	err = client.ReportNodeOnlineUsers(&onlineUserList)
+	err = client.ReportNodeOnlineUsers(context.Background(), &onlineUserList)
 	if err != nil {
 		t.Error(err)
 	}
@@ -114,7 +145,7 @@ func TestReportReportNodeOnlineUsers(t *testing.T) {
 
 func TestReportReportUserTraffic(t *testing.T) {
 	client := CreateClient()
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -127,7 +158,7 @@ func TestReportReportUserTraffic(t *testing.T) {
 		}
 	}
 	//client.Debug()
-	err = client.ReportUserTraffic(&generalUserTraffic)
+	err = client.ReportUserTraffic(context.Background(), &generalUserTraffic)
 	if err != nil {
 		t.Error(err)
 	}
@@ -136,7 +167,7 @@ func TestReportReportUserTraffic(t *testing.T) {
 func TestGetNodeRule(t *testing.T) {
 	client := CreateClient()
 
-	ruleList, err := client.GetNodeRule()
+	ruleList, err := client.GetNodeRule(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -152,8 +183,1266 @@ func TestReportIllegal(t *testing.T) {
 		api.DetectResult{1, 3},
 	}
 	client.Debug()
-	err := client.ReportIllegal(&detectResult)
+	err := client.ReportIllegal(context.Background(), &detectResult)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExportConfig(t *testing.T) {
+	apiConfig := &api.Config{
+		APIHost:  "http://127.0.0.1:667",
+		Key:      "supersecretkey",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	client := newClient(t, apiConfig)
+	data, err := client.ExportConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), apiConfig.Key) {
+		t.Errorf("exported config leaks the key: %s", data)
+	}
+	if !strings.Contains(string(data), `"Timeout": 5`) {
+		t.Errorf("exported config misses the effective timeout: %s", data)
+	}
+	if apiConfig.Key != "supersecretkey" {
+		t.Error("ExportConfig must not modify the original config")
+	}
+}
+
+func TestRejectEmptyUserList(t *testing.T) {
+	users := `[{"id":1,"uuid":"a"},{"id":2,"uuid":"b"},{"id":3,"uuid":"c"},{"id":4,"uuid":"d"},{"id":5,"uuid":"e"}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"ret":1,"data":%s}`, users)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:             server.URL,
+		Key:                 "123",
+		NodeID:              3,
+		NodeType:            "V2ray",
+		RejectEmptyUserList: true,
+	}
+	client := newClient(t, apiConfig)
+	userList, err := client.GetUserList(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*userList) != 5 {
+		t.Fatalf("expected 5 users, got %d", len(*userList))
+	}
+
+	users = `[]`
+	if _, err := client.GetUserList(context.Background()); !errors.Is(err, api.ErrSuspiciousEmptyList) {
+		t.Errorf("expected ErrSuspiciousEmptyList, got %v", err)
+	}
+	// The panel keeps returning it, so all the users were really removed
+	for i := 2; i < api.EmptyUserListConfirmations; i++ {
+		if _, err := client.GetUserList(context.Background()); !errors.Is(err, api.ErrSuspiciousEmptyList) {
+			t.Errorf("empty list %d: expected ErrSuspiciousEmptyList, got %v", i, err)
+		}
+	}
+	if userList, err := client.GetUserList(context.Background()); err != nil || len(*userList) != 0 {
+		t.Errorf("expected the confirmed empty list to be accepted, got %v, %v", userList, err)
+	}
+	if _, err := client.GetUserList(context.Background()); err != nil {
+		t.Errorf("expected the next empty list to be accepted too, got %v", err)
+	}
+
+	// Without the option an empty list is accepted
+	apiConfig.RejectEmptyUserList = false
+	client = newClient(t, apiConfig)
+	if userList, err := client.GetUserList(context.Background()); err != nil || len(*userList) != 0 {
+		t.Errorf("expected an empty list, got %v, %v", userList, err)
+	}
+}
+
+func TestPinnedCertSHA256(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ret":1,"data":[{"id":1,"uuid":"a"}]}`)
+	}))
+	defer server.Close()
+	sum := sha256.Sum256(server.Certificate().Raw)
+
+	apiConfig := &api.Config{
+		APIHost:          server.URL,
+		Key:              "123",
+		NodeID:           3,
+		NodeType:         "V2ray",
+		Transport:        server.Client().Transport,
+		PinnedCertSHA256: hex.EncodeToString(sum[:]),
+	}
+	if _, err := newClient(t, apiConfig).GetUserList(context.Background()); err != nil {
+		t.Errorf("matching pin rejected: %s", err)
+	}
+
+	apiConfig.PinnedCertSHA256 = strings.Repeat("00", sha256.Size)
+	if _, err := newClient(t, apiConfig).GetUserList(context.Background()); err == nil {
+		t.Error("mismatching pin accepted")
+	}
+}
+
+func TestDefaultTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ret":1,"data":{"server":"v2.example.com;10086;0;;tls;path=/v2ray|host=v2.example.com"}}`)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	nodeInfo, err := newClient(t, apiConfig).GetNodeInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeInfo.TransportProtocol != "tcp" {
+		t.Errorf("TransportProtocol = %q, want tcp", nodeInfo.TransportProtocol)
+	}
+
+	apiConfig.DefaultTransport = "ws"
+	nodeInfo, err = newClient(t, apiConfig).GetNodeInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeInfo.TransportProtocol != "ws" {
+		t.Errorf("TransportProtocol = %q, want ws", nodeInfo.TransportProtocol)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/mod_mu/users/detectlog":
+			http.NotFound(w, r)
+		case r.URL.Path == "/mod_mu/users" && r.Method != http.MethodHead:
+			t.Errorf("expected the user list to be probed by HEAD, got %s", r.Method)
+		case r.Method == http.MethodGet:
+			fmt.Fprint(w, `{"ret":1,"data":[]}`)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	result := newClient(t, apiConfig).SelfTest(context.Background())
+	for _, name := range []string{"node_info", "user_list", "node_rule", "node_status", "online_users", "user_traffic"} {
+		if err, ok := result[name]; !ok || err != nil {
+			t.Errorf("%s: expected ok, got %v", name, err)
+		}
+	}
+	if result["illegal"] == nil {
+		t.Error("illegal: expected an error for the 404 endpoint")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, err := range newClient(t, apiConfig).SelfTest(ctx) {
+		if err == nil {
+			t.Errorf("%s: expected the cancelled context to fail the probe", name)
+		}
+	}
+}
+
+func TestResponseMetrics(t *testing.T) {
+	nodeInfoBody := `{"ret":1,"data":{"server":"v2.example.com;10086;0;ws;tls;path=/v2ray|host=v2.example.com"}}`
+	userListBody := `{"ret":1,"data":[{"id":1,"uuid":"a"},{"id":2,"uuid":"b"},{"id":3,"uuid":"c"}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/mod_mu/users" {
+			fmt.Fprint(w, userListBody)
+		} else {
+			fmt.Fprint(w, nodeInfoBody)
+		}
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	client := newClient(t, apiConfig)
+	if _, err := client.GetNodeInfo(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetUserList(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	metrics := client.ResponseMetrics()
+	if m := metrics["node_info"]; m.Bytes != len(nodeInfoBody) {
+		t.Errorf("node_info metric = %+v, want %d bytes", m, len(nodeInfoBody))
+	}
+	if m := metrics["user_list"]; m.Bytes != len(userListBody) || m.Users != 3 {
+		t.Errorf("user_list metric = %+v, want %d bytes and 3 users", m, len(userListBody))
+	}
+}
+
+func TestUnixSocketAPIHost(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "panel.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skipf("unix socket is not supported: %s", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mod_mu/nodes/3/info" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"ret":1,"data":{"server":"v2.example.com;10086;0;ws;tls;path=/v2ray|host=v2.example.com"}}`)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  "unix://" + socketPath,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	nodeInfo, err := newClient(t, apiConfig).GetNodeInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeInfo.Port != 10086 {
+		t.Errorf("Port = %d, want 10086", nodeInfo.Port)
+	}
+}
+
+func TestRuleProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ret":1,"data":[{"id":1,"regex":"google.com"}]}`)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:      server.URL,
+		Key:          "123",
+		NodeID:       3,
+		NodeType:     "V2ray",
+		RuleProvider: api.StaticRules{{ID: -1, Pattern: "baidu.com"}},
+	}
+	ruleList, err := newClient(t, apiConfig).GetNodeRule(context.Background())
 	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*ruleList) != 2 {
+		t.Fatalf("expected the local and panel rules to be merged, got %+v", *ruleList)
+	}
+	if r := (*ruleList)[0]; r.ID != -1 || r.Pattern != "baidu.com" {
+		t.Errorf("unexpected local rule: %+v", r)
+	}
+	if r := (*ruleList)[1]; r.ID != 1 || r.Pattern != "google.com" {
+		t.Errorf("unexpected panel rule: %+v", r)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	if err := newClient(t, apiConfig).WarmUp(context.Background()); err != nil {
 		t.Error(err)
 	}
+
+	apiConfig.APIHost = "http://127.0.0.1:1"
+	if err := newClient(t, apiConfig).WarmUp(context.Background()); err == nil {
+		t.Error("expected an error when the panel is unreachable")
+	}
+}
+
+func TestRuleCacheTTL(t *testing.T) {
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		fmt.Fprint(w, `{"ret":1,"data":[{"id":1,"regex":"google.com"}]}`)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:      server.URL,
+		Key:          "123",
+		NodeID:       3,
+		NodeType:     "V2ray",
+		RuleCacheTTL: 60,
+	}
+	client := newClient(t, apiConfig)
+	for i := 0; i < 2; i++ {
+		ruleList, err := client.GetNodeRule(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*ruleList) != 1 {
+			t.Errorf("unexpected rule list: %+v", *ruleList)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("expected the panel to be hit once within the TTL, got %d", hits)
+	}
+}
+
+// recordingTransport records the path of every request it sends
+type recordingTransport struct {
+	paths []string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.paths = append(t.paths, req.URL.Path)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ret":1,"data":[]}`)
+	}))
+	defer server.Close()
+
+	transport := &recordingTransport{}
+	apiConfig := &api.Config{
+		APIHost:    server.URL,
+		Key:        "123",
+		NodeID:     3,
+		NodeType:   "V2ray",
+		HTTPClient: &http.Client{Transport: transport, Timeout: 7 * time.Second},
+	}
+	client := newClient(t, apiConfig)
+	if _, err := client.GetUserList(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.paths) != 1 || transport.paths[0] != "/mod_mu/users" {
+		t.Errorf("expected the request to go through the custom client, got %v", transport.paths)
+	}
+	if apiConfig.HTTPClient.Timeout != 7*time.Second {
+		t.Errorf("the custom client timeout should be kept, got %s", apiConfig.HTTPClient.Timeout)
+	}
+}
+
+func TestNodeInfoETag(t *testing.T) {
+	var ifNoneMatch string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		if ifNoneMatch == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, `{"ret":1,"data":{"server":"v2.example.com;10086;0;ws;tls;path=/v2ray|host=v2.example.com"}}`)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	client := newClient(t, apiConfig)
+	nodeInfo, err := client.GetNodeInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := client.GetNodeInfo(context.Background())
+	if ifNoneMatch != `"v1"` {
+		t.Errorf("If-None-Match = %q, want the last ETag", ifNoneMatch)
+	}
+	if !errors.Is(err, api.ErrNodeInfoNotModified) {
+		t.Errorf("expected ErrNodeInfoNotModified, got %v", err)
+	}
+	if cached == nil || cached.Port != nodeInfo.Port || cached.Host != nodeInfo.Host {
+		t.Errorf("expected the cached node info %+v, got %+v", nodeInfo, cached)
+	}
+}
+
+func TestShadowsocksNodeInfoSkipsETag(t *testing.T) {
+	method := "aes-128-gcm"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/mod_mu/users" {
+			fmt.Fprintf(w, `{"ret":1,"data":[{"id":1,"port":443,"method":"%s","is_multi_user":1}]}`, method)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, `{"ret":1,"data":{"server":"ss.example.com"}}`)
+	}))
+	defer server.Close()
+
+	client := newClient(t, &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "Shadowsocks",
+	})
+	for _, method = range []string{"aes-128-gcm", "chacha20-ietf-poly1305"} {
+		nodeInfo, err := client.GetNodeInfo(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeInfo.CypherMethod != method {
+			t.Errorf("CypherMethod = %s, want %s from the user list", nodeInfo.CypherMethod, method)
+		}
+	}
+}
+
+func TestChunkedReportResponse(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before the end forces chunked transfer encoding
+		for _, chunk := range []string{`{"ret":1,`, `"data":`, `"ok"}`} {
+			fmt.Fprint(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	var conns int32
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	client := newClient(t, apiConfig)
+	for i := 0; i < 3; i++ {
+		if err := client.ReportNodeStatus(context.Background(), &api.NodeStatus{CPU: 1, Mem: 1, Disk: 1, Uptime: 256}); err != nil {
+			t.Fatalf("the chunked response should be fully read: %s", err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected the connection to be reused, opened %d connections", n)
+	}
+}
+
+func TestReportTemperature(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		fmt.Fprint(w, `{"ret":1,"data":"ok"}`)
+	}))
+	defer server.Close()
+
+	thermalPath := filepath.Join(t.TempDir(), "temp")
+	if err := os.WriteFile(thermalPath, []byte("45500\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	apiConfig := &api.Config{
+		APIHost:           server.URL,
+		Key:               "123",
+		NodeID:            3,
+		NodeType:          "V2ray",
+		ReportTemperature: true,
+		TemperaturePath:   thermalPath,
+	}
+	nodeStatus := &api.NodeStatus{CPU: 1, Mem: 1, Disk: 1, Uptime: 256}
+	if err := newClient(t, apiConfig).ReportNodeStatus(context.Background(), nodeStatus); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, `"cpu_temp":45.5`) {
+		t.Errorf("expected the temperature in the report, got %s", body)
+	}
+
+	// A missing sensor omits the temperature
+	apiConfig.TemperaturePath = filepath.Join(t.TempDir(), "missing")
+	if err := newClient(t, apiConfig).ReportNodeStatus(context.Background(), nodeStatus); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(body, "cpu_temp") {
+		t.Errorf("expected no temperature without a sensor, got %s", body)
+	}
+}
+
+func TestAPIErrorKind(t *testing.T) {
+	respond := func(status int, body string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	cases := []struct {
+		host   string
+		kind   api.ErrorKind
+		status int
+	}{
+		{"", api.NetworkError, 0},
+		{respond(http.StatusInternalServerError, "Internal Server Error"), api.HTTPError, http.StatusInternalServerError},
+		{respond(http.StatusOK, `{"ret":"1"`), api.ParseError, http.StatusOK},
+		{respond(http.StatusOK, `{"ret":0,"data":"token invalid"}`), api.PanelError, http.StatusOK},
+	}
+	// Close the server last, so none of the others reuses its port
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	cases[0].host = closed.URL
+	for _, c := range cases {
+		apiConfig := &api.Config{
+			APIHost:       c.host,
+			Key:           "123",
+			NodeID:        3,
+			NodeType:      "V2ray",
+			RetryWaitTime: 1,
+		}
+		_, err := newClient(t, apiConfig).GetUserList(context.Background())
+		var apiErr *api.APIError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("%s: expected an APIError, got %v", c.kind, err)
+			continue
+		}
+		if apiErr.Kind != c.kind || apiErr.StatusCode != c.status {
+			t.Errorf("got %s with status %d, want %s with status %d: %s", apiErr.Kind, apiErr.StatusCode, c.kind, c.status, err)
+		}
+	}
+}
+
+func TestReportUserTrafficBatches(t *testing.T) {
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var postData struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&postData)
+		batches = append(batches, len(postData.Data))
+		if len(batches) == 2 {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		fmt.Fprint(w, `{"ret":1,"data":"ok"}`)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	userTraffic := make([]api.UserTraffic, 2500)
+	for i := range userTraffic {
+		userTraffic[i] = api.UserTraffic{UID: i + 1, Upload: 100, Download: 200}
+	}
+	err := newClient(t, apiConfig).ReportUserTraffic(context.Background(), &userTraffic)
+	if len(batches) != 3 || batches[0] != 1000 || batches[1] != 1000 || batches[2] != 500 {
+		t.Errorf("expected 3 posts of 1000, 1000 and 500 users, got %v", batches)
+	}
+	if err == nil || !strings.Contains(err.Error(), "batch 2/3") || strings.Contains(err.Error(), "batch 3/3") {
+		t.Errorf("expected only the second batch to be reported as failed, got %v", err)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := newClient(t, apiConfig).GetUserList(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the cancelled request took %s", elapsed)
+	}
+}
+
+func TestRetryOnServerError(t *testing.T) {
+	for _, c := range []struct {
+		status   int
+		requests int32
+	}{
+		{http.StatusServiceUnavailable, 3},
+		{http.StatusForbidden, 1},
+	} {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(c.status)
+		}))
+		apiConfig := &api.Config{
+			APIHost:       server.URL,
+			Key:           "123",
+			NodeID:        3,
+			NodeType:      "V2ray",
+			RetryCount:    2,
+			RetryWaitTime: 1,
+		}
+		if _, err := newClient(t, apiConfig).GetUserList(context.Background()); err == nil {
+			t.Errorf("%d: expected an error", c.status)
+		}
+		server.Close()
+		if requests != c.requests {
+			t.Errorf("%d: got %d requests, want %d", c.status, requests, c.requests)
+		}
+	}
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	var movedPosts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/mod_mu/users":
+			http.Redirect(w, r, "/moved/users", http.StatusFound)
+		case "/moved/users":
+			fmt.Fprint(w, `{"ret":1,"data":[{"id":1,"uuid":"a"}]}`)
+		case "/mod_mu/nodes/3/info":
+			http.Redirect(w, r, "/moved/info", http.StatusTemporaryRedirect)
+		case "/moved/info":
+			atomic.AddInt32(&movedPosts, 1)
+			fmt.Fprint(w, `{"ret":1,"data":"ok"}`)
+		}
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	userList, err := newClient(t, apiConfig).GetUserList(context.Background())
+	if err != nil || len(*userList) != 1 {
+		t.Errorf("expected the GET redirect to be followed, got %v", err)
+	}
+
+	err = newClient(t, apiConfig).ReportNodeStatus(context.Background(), &api.NodeStatus{CPU: 1, Mem: 1, Disk: 1, Uptime: 256})
+	var apiErr *api.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("expected the POST redirect to be returned as an error, got %v", err)
+	}
+	if movedPosts != 0 {
+		t.Errorf("the POST redirect was followed %d times", movedPosts)
+	}
+
+	apiConfig.MaxRedirects = -1
+	if _, err := newClient(t, apiConfig).GetUserList(context.Background()); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusFound {
+		t.Errorf("expected the GET redirect not to be followed, got %v", err)
+	}
+}
+
+func TestNewInvalidAPIHost(t *testing.T) {
+	for _, host := range []string{"", "http://", "ftp://127.0.0.1:667"} {
+		apiConfig := &api.Config{
+			APIHost:  host,
+			Key:      "123",
+			NodeID:   3,
+			NodeType: "V2ray",
+		}
+		client, err := sspanel.New(apiConfig)
+		if err == nil || !strings.Contains(err.Error(), "ApiHost") {
+			t.Errorf("New(%q) = %v, %v, expected an ApiHost error", host, client, err)
+		}
+	}
+}
+
+func TestRegistryNew(t *testing.T) {
+	apiConfig := &api.Config{
+		APIHost:  "http://127.0.0.1:667",
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	client, err := api.New("SSpanel", apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.(*sspanel.APIClient); !ok {
+		t.Errorf("expected a *sspanel.APIClient, got %T", client)
+	}
+
+	// A failed New must not return a non-nil interface
+	apiConfig.APIHost = ""
+	if client, err := api.New("SSpanel", apiConfig); err == nil || client != nil {
+		t.Errorf("expected a nil client and an error, got %v, %v", client, err)
+	}
+}
+
+func TestEventsPollFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	client := newClient(t, apiConfig)
+	events := client.Events()
+	if _, err := client.GetUserList(context.Background()); err == nil {
+		t.Fatal("expected the poll to fail")
+	}
+	select {
+	case event := <-events:
+		if event.Type != api.PollFailed || event.Endpoint != "user_list" || event.Err == nil {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Error("no poll failure event emitted")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"ret":1,"data":"ok"}`)
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+		DryRun:   true,
+	}
+	client := newClient(t, apiConfig)
+	userTraffic := []api.UserTraffic{{UID: 1, Upload: 100, Download: 200}}
+	if err := client.ReportUserTraffic(context.Background(), &userTraffic); err != nil {
+		t.Error(err)
+	}
+	onlineUsers := []api.OnlineUser{{UID: 1, IP: "1.1.1.1"}}
+	if err := client.ReportNodeOnlineUsers(context.Background(), &onlineUsers); err != nil {
+		t.Error(err)
+	}
+	detectResults := []api.DetectResult{{UID: 1, RuleID: 2}}
+	if err := client.ReportIllegal(context.Background(), &detectResults); err != nil {
+		t.Error(err)
+	}
+
+	if requests != 0 {
+		t.Errorf("expected no request in dry run, got %d", requests)
+	}
+	for _, payload := range []string{
+		`/mod_mu/users/traffic: {"data":[{"user_id":1,"u":100,"d":200}]}`,
+		`/mod_mu/users/aliveip: {"data":[{"user_id":1,"ip":"1.1.1.1"}]}`,
+		`/mod_mu/users/detectlog: {"data":[{"list_id":2,"user_id":1}]}`,
+	} {
+		if !strings.Contains(logs.String(), payload) {
+			t.Errorf("payload %s not logged in:\n%s", payload, logs.String())
+		}
+	}
+}
+
+// newRuleServer serves an empty panel rule list
+func newRuleServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ret":1,"data":[]}`)
+	}))
+}
+
+func TestBadLocalRuleList(t *testing.T) {
+	server := newRuleServer()
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "rulelist")
+	content := "baidu.com\n" + strings.Repeat("a", 1<<17) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	apiConfig := &api.Config{
+		APIHost:      server.URL,
+		Key:          "123",
+		NodeID:       3,
+		NodeType:     "V2ray",
+		RuleListPath: path,
+	}
+	ruleList, err := newClient(t, apiConfig).GetNodeRule(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*ruleList) != 1 || (*ruleList)[0].Pattern != "baidu.com" {
+		t.Errorf("expected the rules before the bad line, got %+v", *ruleList)
+	}
+}
+
+func TestLocalRuleListReload(t *testing.T) {
+	server := newRuleServer()
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "rulelist")
+	if err := os.WriteFile(path, []byte("baidu.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	apiConfig := &api.Config{
+		APIHost:      server.URL,
+		Key:          "123",
+		NodeID:       3,
+		NodeType:     "V2ray",
+		RuleListPath: path,
+		RuleCacheTTL: -1,
+	}
+	client := newClient(t, apiConfig)
+	if ruleList, err := client.GetNodeRule(context.Background()); err != nil || len(*ruleList) != 1 {
+		t.Fatalf("expected the rule of the file, got %v, %v", ruleList, err)
+	}
+
+	if err := os.WriteFile(path, []byte("baidu.com\nqq.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The mtime may not tick between two writes this close
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	ruleList, err := client.GetNodeRule(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*ruleList) != 2 || (*ruleList)[1].Pattern != "qq.com" {
+		t.Errorf("expected the edited rule list, got %+v", *ruleList)
+	}
+}
+
+func TestNoRetryOnReport(t *testing.T) {
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:       server.URL,
+		Key:           "123",
+		NodeID:        3,
+		NodeType:      "V2ray",
+		RetryCount:    3,
+		RetryWaitTime: 1,
+	}
+	userTraffic := []api.UserTraffic{{UID: 1, Upload: 100, Download: 200}}
+	if err := newClient(t, apiConfig).ReportUserTraffic(context.Background(), &userTraffic); err == nil {
+		t.Error("expected the 500 to be returned")
+	}
+	// The panel may have saved the traffic before failing, it must not be reported twice
+	if posts != 1 {
+		t.Errorf("expected the traffic to be posted once, got %d", posts)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:       server.URL,
+		Key:           "123",
+		NodeID:        3,
+		NodeType:      "V2ray",
+		RetryCount:    1,
+		RetryWaitTime: 1,
+		RetryPolicy:   api.RetryPolicy{"node_rule": 4, "report": 0},
+	}
+	client := newClient(t, apiConfig)
+	client.GetNodeInfo(context.Background())
+	client.GetUserList(context.Background())
+	client.GetNodeRule(context.Background())
+	userTraffic := []api.UserTraffic{{UID: 1, Upload: 100, Download: 200}}
+	client.ReportUserTraffic(context.Background(), &userTraffic)
+
+	for endpoint, want := range map[string]int{
+		"GET /mod_mu/nodes/3/info":      2,
+		"GET /mod_mu/users":             2,
+		"GET /mod_mu/func/detect_rules": 5,
+		"POST /mod_mu/users/traffic":    1,
+	} {
+		if requests[endpoint] != want {
+			t.Errorf("%s: got %d requests, want %d", endpoint, requests[endpoint], want)
+		}
+	}
+}
+
+func TestHashReportedIPs(t *testing.T) {
+	var reported []struct {
+		UID int    `json:"user_id"`
+		IP  string `json:"ip"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var postData struct {
+			Data json.RawMessage `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&postData)
+		json.Unmarshal(postData.Data, &reported)
+		fmt.Fprint(w, `{"ret":1,"data":"ok"}`)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:         server.URL,
+		Key:             "123",
+		NodeID:          3,
+		NodeType:        "V2ray",
+		HashReportedIPs: true,
+		HashSalt:        "secret",
+	}
+	client := newClient(t, apiConfig)
+	onlineUsers := []api.OnlineUser{{UID: 1, IP: "1.1.1.1"}, {UID: 1, IP: "2.2.2.2"}, {UID: 2, IP: "1.1.1.1"}}
+	if err := client.ReportNodeOnlineUsers(context.Background(), &onlineUsers); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reported) != 3 {
+		t.Fatalf("expected 3 reported IPs, got %+v", reported)
+	}
+	for _, r := range reported {
+		if strings.Contains(r.IP, ".") {
+			t.Errorf("raw IP %s reported", r.IP)
+		}
+	}
+	if reported[0].IP == reported[1].IP || reported[0].IP != reported[2].IP {
+		t.Errorf("expected hashes to tell IPs apart, got %+v", reported)
+	}
+	// The device limit still counts the distinct IPs of each user
+	if client.LastReportOnline[1] != 2 || client.LastReportOnline[2] != 1 {
+		t.Errorf("unexpected online counts: %v", client.LastReportOnline)
+	}
+}
+
+func TestLocalAndRemoteRuleIDs(t *testing.T) {
+	var illegalPosts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/mod_mu/func/detect_rules":
+			fmt.Fprint(w, `{"ret":1,"data":[{"id":0,"regex":"google.com"},{"id":1,"regex":"bing.com"}]}`)
+		case "/mod_mu/users/detectlog":
+			body, _ := io.ReadAll(r.Body)
+			illegalPosts = append(illegalPosts, string(body))
+			fmt.Fprint(w, `{"ret":1,"data":"ok"}`)
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "rulelist")
+	if err := os.WriteFile(path, []byte("baidu.com\nqq.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	apiConfig := &api.Config{
+		APIHost:      server.URL,
+		Key:          "123",
+		NodeID:       3,
+		NodeType:     "V2ray",
+		RuleListPath: path,
+	}
+	client := newClient(t, apiConfig)
+	ruleList, err := client.GetNodeRule(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[int]string)
+	for _, r := range *ruleList {
+		if pattern, ok := ids[r.ID]; ok {
+			t.Errorf("rules %s and %s share the ID %d", pattern, r.Pattern, r.ID)
+		}
+		ids[r.ID] = r.Pattern
+	}
+	if ids[-1] != "baidu.com" || ids[-2] != "qq.com" || ids[0] != "google.com" || ids[1] != "bing.com" {
+		t.Errorf("unexpected rule IDs: %v", ids)
+	}
+
+	detectResults := []api.DetectResult{{UID: 1, RuleID: -2}}
+	if err := client.ReportIllegal(context.Background(), &detectResults); err != nil {
+		t.Fatal(err)
+	}
+	if len(illegalPosts) != 0 {
+		t.Errorf("a local rule hit was reported to the panel: %v", illegalPosts)
+	}
+	detectResults = []api.DetectResult{{UID: 1, RuleID: -2}, {UID: 2, RuleID: 1}}
+	if err := client.ReportIllegal(context.Background(), &detectResults); err != nil {
+		t.Fatal(err)
+	}
+	if len(illegalPosts) != 1 || illegalPosts[0] != `{"data":[{"list_id":1,"user_id":2}]}` {
+		t.Errorf("expected only the panel rule to be reported, got %v", illegalPosts)
+	}
+}
+
+func TestRuleCacheDefaultTTL(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprint(w, `{"ret":1,"data":[{"id":1,"regex":"google.com"}]}`)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	client := newClient(t, apiConfig)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetNodeRule(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if hits != 1 {
+		t.Errorf("expected one request within the default TTL, got %d", hits)
+	}
+	client.InvalidateNodeRule()
+	client.GetNodeRule(context.Background())
+	if hits != 2 {
+		t.Errorf("expected a request after the refresh, got %d", hits)
+	}
+
+	apiConfig.RuleCacheTTL = -1
+	client = newClient(t, apiConfig)
+	client.GetNodeRule(context.Background())
+	client.GetNodeRule(context.Background())
+	if hits != 4 {
+		t.Errorf("expected every call to hit the panel with the cache disabled, got %d", hits)
+	}
+}
+
+func TestGetNodeRuleTypes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ret":1,"data":[{"id":1,"regex":"google.com"},{"id":2,"regex":"example.com","rule_type":"domain"},`+
+			`{"id":3,"regex":"10.0.0.0/8","rule_type":"ip-cidr"},{"id":4,"regex":"bt","rule_type":"protocol"}]}`)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "rulelist")
+	if err := os.WriteFile(path, []byte("domain:baidu.com\nip-cidr:192.168.0.0/16\nqq.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	apiConfig := &api.Config{
+		APIHost:      server.URL,
+		Key:          "123",
+		NodeID:       3,
+		NodeType:     "V2ray",
+		RuleListPath: path,
+	}
+	ruleList, err := newClient(t, apiConfig).GetNodeRule(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[int]string)
+	for _, r := range *ruleList {
+		types[r.ID] = string(r.Type) + ":" + r.Pattern
+	}
+	want := map[int]string{
+		-1: "domain:baidu.com",
+		-2: "ip-cidr:192.168.0.0/16",
+		-3: "regexp:qq.com",
+		1:  "regexp:google.com",
+		2:  "domain:example.com",
+		3:  "ip-cidr:10.0.0.0/8",
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("got rules %v, want %v", types, want)
+	}
+}
+
+func TestReportIllegalDedup(t *testing.T) {
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		fmt.Fprint(w, `{"ret":1,"data":"ok"}`)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:  server.URL,
+		Key:      "123",
+		NodeID:   3,
+		NodeType: "V2ray",
+	}
+	client := newClient(t, apiConfig)
+	detectResults := []api.DetectResult{{UID: 1, RuleID: 2}}
+	for i := 0; i < 2; i++ {
+		if err := client.ReportIllegal(context.Background(), &detectResults); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&posts); n != 1 {
+		t.Errorf("expected the repeated hit to be posted once, got %d posts", n)
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("key") {
+		case "good":
+			fmt.Fprint(w, `{"ret":1,"data":{"server":"v2.example.com;10086;0;ws;tls;path=/v2ray","sort":11}}`)
+		case "missing":
+			fmt.Fprint(w, `{"ret":1,"data":null}`)
+		case "bad":
+			fmt.Fprint(w, `{"ret":0,"data":"token is invalid"}`)
+		case "unauthorized":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		key    string
+		kind   api.ErrorKind
+		status int
+	}{
+		{"bad", api.PanelError, http.StatusOK},
+		{"unauthorized", api.HTTPError, http.StatusUnauthorized},
+		{"forbidden", api.HTTPError, http.StatusForbidden},
+	}
+	newPingClient := func(key string) *sspanel.APIClient {
+		return newClient(t, &api.Config{
+			APIHost:  server.URL,
+			Key:      key,
+			NodeID:   3,
+			NodeType: "V2ray",
+		})
+	}
+	if err := newPingClient("good").Ping(context.Background()); err != nil {
+		t.Errorf("expected a good key to pass, got %v", err)
+	}
+	if err := newPingClient("missing").Ping(context.Background()); !errors.Is(err, api.ErrNodeNotFound) {
+		t.Errorf("expected ErrNodeNotFound for an unknown node, got %v", err)
+	}
+	for _, c := range cases {
+		err := newPingClient(c.key).Ping(context.Background())
+		var apiErr *api.APIError
+		if !errors.As(err, &apiErr) || apiErr.Kind != c.kind || apiErr.StatusCode != c.status {
+			t.Errorf("key %s: expected a %s error with status %d, got %v", c.key, c.kind, c.status, err)
+		}
+	}
+}
+
+func TestOnlineWindow(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		fmt.Fprint(w, `{"ret":1,"data":"ok"}`)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:      server.URL,
+		Key:          "123",
+		NodeID:       3,
+		NodeType:     "V2ray",
+		OnlineWindow: 60,
+	}
+	client := newClient(t, apiConfig)
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		if err := client.ReportNodeOnlineUsers(context.Background(), &[]api.OnlineUser{{UID: 1, IP: ip}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `{"data":[{"user_id":1,"ip":"1.1.1.1"},{"user_id":1,"ip":"2.2.2.2"}]}`
+	if string(body) != want {
+		t.Errorf("expected the IP of the previous poll to be kept, got %s", body)
+	}
+	if client.LastReportOnline[1] != 2 {
+		t.Errorf("expected 2 online IPs for the user, got %d", client.LastReportOnline[1])
+	}
+
+	body = nil
+	if err := client.ReportNodeOnlineUsers(context.Background(), &[]api.OnlineUser{}); err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != want {
+		t.Errorf("expected the IPs within the window to be reported when none is connected, got %s", body)
+	}
+
+	body = nil
+	apiConfig.OnlineWindow = 0
+	if err := newClient(t, apiConfig).ReportNodeOnlineUsers(context.Background(), &[]api.OnlineUser{}); err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		t.Errorf("expected no report without online users, got %s", body)
+	}
+}
+
+func TestRateLimitError(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	apiConfig := &api.Config{
+		APIHost:       server.URL,
+		Key:           "123",
+		NodeID:        3,
+		NodeType:      "V2ray",
+		RetryCount:    1,
+		RetryWaitTime: 1,
+	}
+	start := time.Now()
+	_, err := newClient(t, apiConfig).GetNodeInfo(context.Background())
+	var apiErr *api.APIError
+	if !errors.As(err, &apiErr) || apiErr.Kind != api.RateLimitError || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a rate limit error, got %v", err)
+	}
+	if apiErr.RetryAfter != 120*time.Second {
+		t.Errorf("expected the parsed Retry-After of 120s, got %s", apiErr.RetryAfter)
+	}
+	// The retry waits for Retry-After, capped at the max retry wait
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("expected the 429 to be retried once, got %d requests", n)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the retry wait to be capped, took %s", elapsed)
+	}
 }
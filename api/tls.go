@@ -0,0 +1,41 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// VerifyPinnedCert returns a tls VerifyConnection callback which rejects any server
+// certificate whose SHA-256 fingerprint does not match pin.
+// The pin is a hex string, colons and spaces are ignored.
+func VerifyPinnedCert(pin string) func(tls.ConnectionState) error {
+	pin = strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(pin))
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("no server certificate to verify the pin")
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if fingerprint := hex.EncodeToString(sum[:]); fingerprint != pin {
+			return fmt.Errorf("server certificate %s does not match the pinned certificate", fingerprint)
+		}
+		return nil
+	}
+}
+
+// PinnedTransport returns a copy of transport which only accepts the pinned server certificate
+func PinnedTransport(transport http.RoundTripper, pin string) (http.RoundTripper, error) {
+	t, ok := transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("certificate pinning requires a *http.Transport, got %T", transport)
+	}
+	t = t.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = new(tls.Config)
+	}
+	t.TLSClientConfig.VerifyConnection = VerifyPinnedCert(pin)
+	return t, nil
+}
@@ -0,0 +1,22 @@
+package api
+
+// SyncTLSSettings fills TLSSettings from the legacy EnableTLS, TLSType and Host fields
+func (n *NodeInfo) SyncTLSSettings() {
+	n.TLSSettings = TLSSettings{
+		Enable: n.EnableTLS,
+		Type:   n.TLSType,
+	}
+	if n.EnableTLS {
+		n.TLSSettings.ServerName = n.Host
+	}
+}
+
+// TLS returns TLSSettings, or the settings from the legacy fields for a NodeInfo built without it
+func (n *NodeInfo) TLS() TLSSettings {
+	if n.TLSSettings != (TLSSettings{}) {
+		return n.TLSSettings
+	}
+	legacy := *n
+	legacy.SyncTLSSettings()
+	return legacy.TLSSettings
+}
@@ -0,0 +1,22 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestSyncTLSSettings(t *testing.T) {
+	nodeInfo := &api.NodeInfo{EnableTLS: true, TLSType: "xtls", Host: "node.example.com"}
+	nodeInfo.SyncTLSSettings()
+	want := api.TLSSettings{Enable: true, Type: "xtls", ServerName: "node.example.com"}
+	if nodeInfo.TLSSettings != want {
+		t.Errorf("TLSSettings = %+v, want %+v", nodeInfo.TLSSettings, want)
+	}
+
+	// A NodeInfo built without TLSSettings still reports its legacy fields
+	legacy := &api.NodeInfo{EnableTLS: true, TLSType: "tls", Host: "node.example.com"}
+	if tls := legacy.TLS(); !tls.Enable || tls.Type != "tls" || tls.ServerName != "node.example.com" {
+		t.Errorf("TLS() = %+v does not match the legacy fields", tls)
+	}
+}
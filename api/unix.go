@@ -0,0 +1,35 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const unixSocketScheme = "unix://"
+
+// UnixSocketPath returns the socket path of an APIHost like unix:///path/to.sock
+func UnixSocketPath(host string) (string, bool) {
+	if !strings.HasPrefix(host, unixSocketScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(host, unixSocketScheme), true
+}
+
+// UnixSocketTransport returns a copy of transport which sends every request over the unix socket
+func UnixSocketTransport(transport http.RoundTripper, socketPath string) (http.RoundTripper, error) {
+	t, ok := transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("unix socket requires a *http.Transport, got %T", transport)
+	}
+	t = t.Clone()
+	dialer := &net.Dialer{}
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+	// Never send the socket traffic to a proxy
+	t.Proxy = nil
+	return t, nil
+}
@@ -0,0 +1,32 @@
+package api
+
+// DedupUserList removes the users with a duplicated UID or UUID in place,
+// keeping the last occurrence, and returns how many users were removed.
+func DedupUserList(userList *[]UserInfo) (removed int) {
+	users := *userList
+	seenUID := make(map[int]bool, len(users))
+	seenUUID := make(map[string]bool, len(users))
+	kept := make([]UserInfo, 0, len(users))
+	// Walk backwards so the last occurrence wins
+	for i := len(users) - 1; i >= 0; i-- {
+		u := users[i]
+		if seenUID[u.UID] || (u.UUID != "" && seenUUID[u.UUID]) {
+			removed++
+			continue
+		}
+		seenUID[u.UID] = true
+		if u.UUID != "" {
+			seenUUID[u.UUID] = true
+		}
+		kept = append(kept, u)
+	}
+	if removed == 0 {
+		return 0
+	}
+	// Restore the original order
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	*userList = kept
+	return removed
+}
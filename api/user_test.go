@@ -0,0 +1,34 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestDedupUserList(t *testing.T) {
+	userList := []api.UserInfo{
+		{UID: 1, Email: "first", UUID: "uuid-1"},
+		{UID: 2, Email: "other", UUID: "uuid-2"},
+		{UID: 1, Email: "last", UUID: "uuid-1"},
+		{UID: 3, Email: "same uuid", UUID: "uuid-2"},
+	}
+	if removed := api.DedupUserList(&userList); removed != 2 {
+		t.Errorf("removed = %d, want 2", removed)
+	}
+	if len(userList) != 2 {
+		t.Fatalf("expected 2 users, got %+v", userList)
+	}
+	if userList[0].UID != 1 || userList[0].Email != "last" {
+		t.Errorf("the last occurrence of UID 1 should be kept, got %+v", userList[0])
+	}
+	if userList[1].UID != 3 {
+		t.Errorf("the last occurrence of uuid-2 should be kept, got %+v", userList[1])
+	}
+
+	// Shadowsocks users have no UUID
+	ssUserList := []api.UserInfo{{UID: 1}, {UID: 2}}
+	if removed := api.DedupUserList(&ssUserList); removed != 0 || len(ssUserList) != 2 {
+		t.Errorf("users without UUID must not collide: %+v", ssUserList)
+	}
+}
@@ -1,13 +1,11 @@
 package v2board
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"strconv"
-	"time"
 
 	"github.com/XrayR-project/XrayR/api"
 	"github.com/bitly/go-simplejson"
@@ -16,36 +14,40 @@ import (
 
 // APIClient create a api client to the panel.
 type APIClient struct {
-	client        *resty.Client
-	APIHost       string
-	NodeID        int
-	Key           string
-	NodeType      string
-	EnableVless   bool
-	EnableXTLS    bool
-	SpeedLimit    float64
-	DeviceLimit   int
-	LocalRuleList []api.DetectRule
+	*api.ClientBase
+	client           *resty.Client
+	APIHost          string
+	NodeID           int
+	Key              string
+	NodeType         string
+	EnableVless      bool
+	EnableXTLS       bool
+	SpeedLimit       float64
+	DeviceLimit      int
+	DryRun           bool
+	DefaultTransport string
+	TrafficBatchSize int
+	userListGuard    api.UserListGuard
+	nodeInfoCache    api.NodeInfoCache
+}
+
+func init() {
+	api.Register("V2board", func(apiConfig *api.Config) (api.API, error) {
+		apiClient, err := New(apiConfig)
+		if err != nil {
+			return nil, err
+		}
+		return apiClient, nil
+	})
 }
 
 // New creat a api instance
-func New(apiConfig *api.Config) *APIClient {
+func New(apiConfig *api.Config) (*APIClient, error) {
 
-	client := resty.New()
-	client.SetRetryCount(3)
-	if apiConfig.Timeout > 0 {
-		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
-	} else {
-		client.SetTimeout(5 * time.Second)
+	client, apiHost, err := api.NewRestyClient(apiConfig)
+	if err != nil {
+		return nil, err
 	}
-	client.OnError(func(req *resty.Request, err error) {
-		if v, ok := err.(*resty.ResponseError); ok {
-			// v.Response contains the last response from the server
-			// v.Err contains the original error
-			log.Print(v.Err)
-		}
-	})
-	client.SetHostURL(apiConfig.APIHost)
 	// Create Key for each requests
 	client.SetQueryParam("key", apiConfig.Key)
 	client.SetQueryParams(map[string]string{
@@ -53,56 +55,23 @@ func New(apiConfig *api.Config) *APIClient {
 		"token":      apiConfig.Key,
 		"local_port": "1",
 	})
-	// Read local rule list
-	localRuleList := readLocalRuleList(apiConfig.RuleListPath)
 	apiClient := &APIClient{
-		client:        client,
-		NodeID:        apiConfig.NodeID,
-		Key:           apiConfig.Key,
-		APIHost:       apiConfig.APIHost,
-		NodeType:      apiConfig.NodeType,
-		EnableVless:   apiConfig.EnableVless,
-		EnableXTLS:    apiConfig.EnableXTLS,
-		SpeedLimit:    apiConfig.SpeedLimit,
-		DeviceLimit:   apiConfig.DeviceLimit,
-		LocalRuleList: localRuleList,
-	}
-	return apiClient
-}
-
-// readLocalRuleList reads the local rule list file
-func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
-
-	LocalRuleList = make([]api.DetectRule, 0)
-	if path != "" {
-		// open the file
-		file, err := os.Open(path)
-
-		//handle errors while opening
-		if err != nil {
-			log.Printf("Error when opening file: %s", err)
-			return LocalRuleList
-		}
-
-		fileScanner := bufio.NewScanner(file)
-
-		// read line by line
-		for fileScanner.Scan() {
-			LocalRuleList = append(LocalRuleList, api.DetectRule{
-				ID:      -1,
-				Pattern: fileScanner.Text(),
-			})
-		}
-		// handle first encountered error while reading
-		if err := fileScanner.Err(); err != nil {
-			log.Fatalf("Error while reading file: %s", err)
-			return make([]api.DetectRule, 0)
-		}
-
-		file.Close()
+		ClientBase:       api.NewClientBase(apiConfig, client, apiHost),
+		client:           client,
+		NodeID:           apiConfig.NodeID,
+		Key:              apiConfig.Key,
+		APIHost:          apiHost,
+		NodeType:         apiConfig.NodeType,
+		EnableVless:      apiConfig.EnableVless,
+		EnableXTLS:       apiConfig.EnableXTLS,
+		SpeedLimit:       apiConfig.SpeedLimit,
+		DeviceLimit:      apiConfig.DeviceLimit,
+		DryRun:           apiConfig.DryRun,
+		DefaultTransport: api.DefaultTransportOf(apiConfig),
+		TrafficBatchSize: apiConfig.TrafficBatchSize,
+		userListGuard:    api.UserListGuard{RejectEmpty: apiConfig.RejectEmptyUserList},
 	}
-
-	return LocalRuleList
+	return apiClient, nil
 }
 
 // Describe return a description of the client
@@ -115,28 +84,88 @@ func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
 }
 
+// Ping fetches the node config, or the user list of a Shadowsocks node which has none, without parsing it
+func (c *APIClient) Ping(ctx context.Context) error {
+	ctx = api.WithRetryEndpoint(ctx, "node_info")
+	var path string
+	switch c.NodeType {
+	case "V2ray":
+		path = "/api/v1/server/Deepbwork/config"
+	case "Trojan":
+		path = "/api/v1/server/TrojanTidalab/config"
+	case "Shadowsocks":
+		path = "/api/v1/server/ShadowsocksTidalab/user"
+	default:
+		return fmt.Errorf("Unsupported Node type: %s", c.NodeType)
+	}
+	res, err := c.client.R().SetContext(ctx).
+		ForceContentType("application/json").
+		Get(path)
+	_, err = c.parseResponse(res, path, err)
+	return err
+}
+
+// SelfTest fetches the node config but for Shadowsocks, and probes the user list and the traffic submit by HEAD
+func (c *APIClient) SelfTest(ctx context.Context) map[string]error {
+	var prefix string
+	switch c.NodeType {
+	case "V2ray":
+		prefix = "/api/v1/server/Deepbwork"
+	case "Trojan":
+		prefix = "/api/v1/server/TrojanTidalab"
+	case "Shadowsocks":
+		prefix = "/api/v1/server/ShadowsocksTidalab"
+	default:
+		return map[string]error{"node_info": fmt.Errorf("Unsupported Node type: %s", c.NodeType)}
+	}
+	result := make(map[string]error)
+	// Shadowsocks node info is derived from the user list
+	if c.NodeType != "Shadowsocks" {
+		path := prefix + "/config"
+		res, err := c.client.R().SetContext(ctx).
+			ForceContentType("application/json").
+			Get(path)
+		_, result["node_info"] = c.parseResponse(res, path, err)
+	}
+	result["user_list"] = api.CheckHeadEndpoint(c.client.R().SetContext(ctx), prefix+"/user")
+	result["user_traffic"] = api.CheckHeadEndpoint(c.client.R().SetContext(ctx), prefix+"/submit")
+	return result
+}
+
 func (c *APIClient) assembleURL(path string) string {
 	return c.APIHost + path
 }
 
 func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (*simplejson.Json, error) {
 	if err != nil {
-		return nil, fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)
+		statusCode := 0
+		if res != nil {
+			statusCode = res.StatusCode()
+		}
+		return nil, api.NewRequestError(c.assembleURL(path), statusCode, err)
 	}
 
+	if api.IsRedirect(res.StatusCode()) {
+		return nil, &api.APIError{Kind: api.HTTPError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: "redirect to " + res.Header().Get("Location") + " not followed"}
+	}
+	if rateLimitErr := api.NewRateLimitError(c.assembleURL(path), res); rateLimitErr != nil {
+		return nil, rateLimitErr
+	}
 	if res.StatusCode() > 400 {
 		body := res.Body()
-		return nil, fmt.Errorf("request %s failed: %s, %s", c.assembleURL(path), string(body), err)
+		return nil, &api.APIError{Kind: api.HTTPError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: string(body)}
 	}
 	rtn, err := simplejson.NewJson(res.Body())
 	if err != nil {
-		return nil, fmt.Errorf("Ret %s invalid", res.String())
+		return nil, &api.APIError{Kind: api.ParseError, URL: c.assembleURL(path), StatusCode: res.StatusCode(), Message: res.String(), Err: err}
 	}
 	return rtn, nil
 }
 
 // GetNodeInfo will pull NodeInfo Config from sspanel
-func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
+func (c *APIClient) GetNodeInfo(ctx context.Context) (nodeInfo *api.NodeInfo, err error) {
+	defer c.Emitter.Poll("node_info", &err)
+	ctx = api.WithRetryEndpoint(ctx, "node_info")
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -144,44 +173,69 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 	case "Trojan":
 		path = "/api/v1/server/TrojanTidalab/config"
 	case "Shadowsocks":
-		if nodeInfo, err = c.ParseSSNodeResponse(); err == nil {
-			return nodeInfo, nil
-		} else {
-			return nil, err
-		}
 	default:
 		return nil, fmt.Errorf("Unsupported Node type: %s", c.NodeType)
 	}
-	res, err := c.client.R().
-		ForceContentType("application/json").
-		Get(path)
 
-	response, err := c.parseResponse(res, path, err)
-	if err != nil {
-		return nil, err
-	}
+	var res *resty.Response
+	if c.NodeType == "Shadowsocks" {
+		// The Shadowsocks node info is derived from the user list, there is no node_info response
+		if nodeInfo, err = c.ParseSSNodeResponse(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		req := c.client.R().SetContext(ctx)
+		// The AlterID of a V2ray node comes from the user list, a 304 would keep it stale
+		if c.NodeType != "V2ray" {
+			req = c.nodeInfoCache.SetIfNoneMatch(req)
+		}
+		res, err = req.
+			ForceContentType("application/json").
+			Get(path)
 
-	switch c.NodeType {
-	case "V2ray":
-		nodeInfo, err = c.ParseV2rayNodeResponse(response)
-	case "Trojan":
-		nodeInfo, err = c.ParseTrojanNodeResponse(response)
-	case "Shadowsocks":
-		nodeInfo, err = c.ParseSSNodeResponse()
-	default:
-		return nil, fmt.Errorf("Unsupported Node type: %s", c.NodeType)
-	}
+		if cached, ok := c.nodeInfoCache.NotModified(res); ok && err == nil {
+			return cached, api.ErrNodeInfoNotModified
+		}
+		response, err := c.parseResponse(res, path, err)
+		if err != nil {
+			return nil, err
+		}
 
-	if err != nil {
-		res, _ := response.MarshalJSON()
-		return nil, fmt.Errorf("Parse node info failed: %s", string(res))
+		if c.NodeType == "V2ray" {
+			nodeInfo, err = c.ParseV2rayNodeResponse(ctx, response)
+		} else {
+			nodeInfo, err = c.ParseTrojanNodeResponse(response)
+		}
+		if err != nil {
+			res, _ := response.MarshalJSON()
+			return nil, fmt.Errorf("Parse node info failed: %s", string(res))
+		}
+		c.Metrics.RecordResponse(c.client, "node_info", res)
 	}
 
+	api.FinishNodeInfo(nodeInfo, c.DefaultTransport)
+	c.nodeInfoCache.Store(res, nodeInfo)
+	c.Emitter.NodeInfo(nodeInfo)
 	return nodeInfo, nil
 }
 
 // GetUserList will pull user form sspanel
-func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
+func (c *APIClient) GetUserList(ctx context.Context) (UserList *[]api.UserInfo, err error) {
+	defer c.Emitter.Poll("user_list", &err)
+	userList, res, err := c.fetchUserList(api.WithRetryEndpoint(ctx, "user_list"))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.userListGuard.Check(userList); err != nil {
+		return nil, err
+	}
+	c.Metrics.RecordUserList(c.client, res, len(*userList))
+	return userList, nil
+}
+
+// fetchUserList downloads the user list without checking it.
+// The node info reads it too, which must not count as a user_list poll.
+func (c *APIClient) fetchUserList(ctx context.Context) (*[]api.UserInfo, *resty.Response, error) {
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -191,22 +245,24 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 	case "Shadowsocks":
 		path = "/api/v1/server/ShadowsocksTidalab/user"
 	default:
-		return nil, fmt.Errorf("Unsupported Node type: %s", c.NodeType)
+		return nil, nil, fmt.Errorf("Unsupported Node type: %s", c.NodeType)
 	}
-	res, err := c.client.R().
+	res, err := c.client.R().SetContext(ctx).
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
 		ForceContentType("application/json").
 		Get(path)
 
 	response, err := c.parseResponse(res, path, err)
 	if err != nil {
-		return nil, err
+		return nil, res, err
 	}
 	numOfUsers := len(response.Get("data").MustArray())
 	userList := make([]api.UserInfo, numOfUsers)
 	for i := 0; i < numOfUsers; i++ {
 		user := api.UserInfo{}
-		user.UID = response.Get("data").GetIndex(i).Get("id").MustInt()
+		if user.UID, err = flexibleInt(response.Get("data").GetIndex(i).Get("id")); err != nil {
+			return nil, res, fmt.Errorf("user %d id: %s", i, err)
+		}
 		user.SpeedLimit = uint64(c.SpeedLimit * 1000000 / 8)
 		user.DeviceLimit = c.DeviceLimit
 		switch c.NodeType {
@@ -214,22 +270,31 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 			user.Email = response.Get("data").GetIndex(i).Get("secret").MustString()
 			user.Passwd = response.Get("data").GetIndex(i).Get("secret").MustString()
 			user.Method = response.Get("data").GetIndex(i).Get("cipher").MustString()
-			user.Port = response.Get("data").GetIndex(i).Get("port").MustInt()
+			if user.Port, err = flexibleInt(response.Get("data").GetIndex(i).Get("port")); err != nil {
+				return nil, res, fmt.Errorf("user %d port: %s", user.UID, err)
+			}
 		case "Trojan":
 			user.UUID = response.Get("data").GetIndex(i).Get("trojan_user").Get("password").MustString()
 			user.Email = response.Get("data").GetIndex(i).Get("trojan_user").Get("password").MustString()
 		case "V2ray":
 			user.UUID = response.Get("data").GetIndex(i).Get("v2ray_user").Get("uuid").MustString()
 			user.Email = response.Get("data").GetIndex(i).Get("v2ray_user").Get("email").MustString()
-			user.AlterID = response.Get("data").GetIndex(i).Get("v2ray_user").Get("alter_id").MustInt()
+			if user.AlterID, err = flexibleInt(response.Get("data").GetIndex(i).Get("v2ray_user").Get("alter_id")); err != nil {
+				return nil, res, fmt.Errorf("user %d alter_id: %s", user.UID, err)
+			}
 		}
 		userList[i] = user
 	}
-	return &userList, nil
+	return &userList, res, nil
 }
 
 // ReportUserTraffic reports the user traffic
-func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
+func (c *APIClient) ReportUserTraffic(ctx context.Context, userTraffic *[]api.UserTraffic) error {
+	return api.ReportInBatches(api.WithRetryEndpoint(ctx, "report"), *userTraffic, c.TrafficBatchSize, c.reportUserTraffic)
+}
+
+// reportUserTraffic reports a single batch of user traffic
+func (c *APIClient) reportUserTraffic(ctx context.Context, userTraffic []api.UserTraffic) error {
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -240,15 +305,19 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 		path = "/api/v1/server/ShadowsocksTidalab/submit"
 	}
 
-	data := make([]UserTraffic, len(*userTraffic))
-	for i, traffic := range *userTraffic {
+	data := make([]UserTraffic, len(userTraffic))
+	for i, traffic := range userTraffic {
 		data[i] = UserTraffic{
 			UID:      traffic.UID,
 			Upload:   traffic.Upload,
 			Download: traffic.Download}
 	}
 
-	res, err := c.client.R().
+	if c.DryRun {
+		api.LogDryRun(path, data)
+		return nil
+	}
+	res, err := c.client.R().SetContext(ctx).
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
 		SetBody(data).
 		ForceContentType("application/json").
@@ -261,15 +330,24 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 }
 
 // GetNodeRule implements the API interface
-func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
-	ruleList := c.LocalRuleList
+func (c *APIClient) GetNodeRule(ctx context.Context) (ruleList *[]api.DetectRule, err error) {
+	defer c.Emitter.Poll("node_rule", &err)
+	ctx = api.WithRetryEndpoint(ctx, "node_rule")
+	return c.RuleCache.Get(func() (*[]api.DetectRule, error) {
+		return c.getNodeRule(ctx)
+	})
+}
+
+// getNodeRule fetches the rule list bypassing the cache
+func (c *APIClient) getNodeRule(ctx context.Context) (*[]api.DetectRule, error) {
+	ruleList := api.LocalRules(&c.Config)
 	if c.NodeType != "V2ray" {
 		return &ruleList, nil
 	}
 
 	// V2board only support the rule for v2ray
 	path := "/api/v1/server/Deepbwork/config"
-	res, err := c.client.R().
+	res, err := c.client.R().SetContext(ctx).
 		ForceContentType("application/json").
 		Get(path)
 
@@ -279,9 +357,12 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	}
 	ruleListResponse := response.Get("routing").Get("rules").GetIndex(1).Get("domain").MustStringArray()
 	for i, rule := range ruleListResponse {
-		ruleListItem := api.DetectRule{
-			ID:      i,
-			Pattern: rule,
+		// The rules use the Xray domain syntax, e.g. domain:example.com
+		ruleType, pattern := api.SplitRuleType(rule)
+		ruleListItem, err := api.NewDetectRule(i, ruleType, pattern)
+		if err != nil {
+			log.Printf("Skip the invalid rule %d: %s", i, err)
+			continue
 		}
 		ruleList = append(ruleList, ruleListItem)
 	}
@@ -289,27 +370,42 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 }
 
 // ReportNodeStatus implements the API interface
-func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
+func (c *APIClient) ReportNodeStatus(ctx context.Context, nodeStatus *api.NodeStatus) (err error) {
 	return nil
 }
 
 //ReportNodeOnlineUsers implements the API interface
-func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) error {
+func (c *APIClient) ReportNodeOnlineUsers(ctx context.Context, onlineUserList *[]api.OnlineUser) error {
 	return nil
 }
 
 // ReportIllegal implements the API interface
-func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
+func (c *APIClient) ReportIllegal(ctx context.Context, detectResultList *[]api.DetectResult) error {
+	c.Emitter.RuleHit(*detectResultList)
 	return nil
 }
 
+// flexibleInt decodes j as an api.FlexibleInt, as V2board may send the ports and ids as numeric strings like "443"
+func flexibleInt(j *simplejson.Json) (int, error) {
+	data, err := j.MarshalJSON()
+	if err != nil {
+		return 0, err
+	}
+	var n api.FlexibleInt
+	err = json.Unmarshal(data, &n)
+	return int(n), err
+}
+
 // ParseTrojanNodeResponse parse the response for the given nodeinfor format
 func (c *APIClient) ParseTrojanNodeResponse(nodeInfoResponse *simplejson.Json) (*api.NodeInfo, error) {
 	var TLSType = "tls"
 	if c.EnableXTLS {
 		TLSType = "xtls"
 	}
-	port := nodeInfoResponse.Get("local_port").MustInt()
+	port, err := flexibleInt(nodeInfoResponse.Get("local_port"))
+	if err != nil {
+		return nil, fmt.Errorf("local_port: %s", err)
+	}
 	host := nodeInfoResponse.Get("ssl").Get("sni").MustString()
 
 	// Create GeneralNodeInfo
@@ -326,10 +422,10 @@ func (c *APIClient) ParseTrojanNodeResponse(nodeInfoResponse *simplejson.Json) (
 }
 
 // ParseSSNodeResponse parse the response for the given nodeinfor format
-func (c *APIClient) ParseSSNodeResponse() (*api.NodeInfo, error) {
+func (c *APIClient) ParseSSNodeResponse(ctx context.Context) (*api.NodeInfo, error) {
 	var port int
 	var method string
-	userInfo, err := c.GetUserList()
+	userInfo, _, err := c.fetchUserList(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -351,7 +447,7 @@ func (c *APIClient) ParseSSNodeResponse() (*api.NodeInfo, error) {
 }
 
 // ParseV2rayNodeResponse parse the response for the given nodeinfor format
-func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *simplejson.Json) (*api.NodeInfo, error) {
+func (c *APIClient) ParseV2rayNodeResponse(ctx context.Context, nodeInfoResponse *simplejson.Json) (*api.NodeInfo, error) {
 	var TLSType string = "tls"
 	var path, host, serviceName string
 	var header json.RawMessage
@@ -361,7 +457,10 @@ func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *simplejson.Json) (*
 		TLSType = "xtls"
 	}
 	inboundInfo := nodeInfoResponse.Get("inbound")
-	port := inboundInfo.Get("port").MustInt()
+	port, err := flexibleInt(inboundInfo.Get("port"))
+	if err != nil {
+		return nil, fmt.Errorf("inbound port: %s", err)
+	}
 	transportProtocol := inboundInfo.Get("streamSettings").Get("network").MustString()
 
 	switch transportProtocol {
@@ -388,7 +487,7 @@ func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *simplejson.Json) (*
 		enableTLS = false
 	}
 
-	userInfo, err := c.GetUserList()
+	userInfo, _, err := c.fetchUserList(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -1,10 +1,16 @@
 package v2board_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/XrayR-project/XrayR/api"
 	"github.com/XrayR-project/XrayR/api/v2board"
+	"github.com/bitly/go-simplejson"
 )
 
 func CreateClient() api.API {
@@ -14,13 +20,16 @@ func CreateClient() api.API {
 		NodeID:   1,
 		NodeType: "V2ray",
 	}
-	client := v2board.New(apiConfig)
+	client, err := v2board.New(apiConfig)
+	if err != nil {
+		panic(err)
+	}
 	return client
 }
 
 func TestGetV2rayNodeinfo(t *testing.T) {
 	client := CreateClient()
-	nodeInfo, err := client.GetNodeInfo()
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -34,8 +43,11 @@ func TestGetSSNodeinfo(t *testing.T) {
 		NodeID:   1,
 		NodeType: "Shadowsocks",
 	}
-	client := v2board.New(apiConfig)
-	nodeInfo, err := client.GetNodeInfo()
+	client, err := v2board.New(apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -49,8 +61,11 @@ func TestGetTrojanNodeinfo(t *testing.T) {
 		NodeID:   1,
 		NodeType: "Trojan",
 	}
-	client := v2board.New(apiConfig)
-	nodeInfo, err := client.GetNodeInfo()
+	client, err := v2board.New(apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeInfo, err := client.GetNodeInfo(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -60,7 +75,7 @@ func TestGetTrojanNodeinfo(t *testing.T) {
 func TestGetUserList(t *testing.T) {
 	client := CreateClient()
 
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -70,7 +85,7 @@ func TestGetUserList(t *testing.T) {
 
 func TestReportReportUserTraffic(t *testing.T) {
 	client := CreateClient()
-	userList, err := client.GetUserList()
+	userList, err := client.GetUserList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -83,7 +98,7 @@ func TestReportReportUserTraffic(t *testing.T) {
 		}
 	}
 	//client.Debug()
-	err = client.ReportUserTraffic(&generalUserTraffic)
+	err = client.ReportUserTraffic(context.Background(), &generalUserTraffic)
 	if err != nil {
 		t.Error(err)
 	}
@@ -92,10 +107,164 @@ func TestReportReportUserTraffic(t *testing.T) {
 func TestGetNodeRule(t *testing.T) {
 	client := CreateClient()
 	client.Debug()
-	ruleList, err := client.GetNodeRule()
+	ruleList, err := client.GetNodeRule(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
 
 	t.Log(ruleList)
 }
+
+func TestParseNumericPort(t *testing.T) {
+	client, err := v2board.New(&api.Config{
+		APIHost:  "http://localhost:9897",
+		Key:      "qwertyuiopasdfghjkl",
+		NodeID:   1,
+		NodeType: "Trojan",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		`{"local_port":443,"ssl":{"sni":"trojan.example.com"}}`,
+		`{"local_port":"443","ssl":{"sni":"trojan.example.com"}}`,
+	} {
+		nodeInfoResponse, err := simplejson.NewJson([]byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodeInfo, err := client.ParseTrojanNodeResponse(nodeInfoResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeInfo.Port != 443 {
+			t.Errorf("%s: Port = %d, want 443", body, nodeInfo.Port)
+		}
+	}
+	nodeInfoResponse, _ := simplejson.NewJson([]byte(`{"local_port":"auto","ssl":{"sni":"trojan.example.com"}}`))
+	if _, err := client.ParseTrojanNodeResponse(nodeInfoResponse); err == nil {
+		t.Error("expected an error for a non numeric port")
+	}
+}
+
+func TestShadowsocksNodeChanged(t *testing.T) {
+	cipher := "aes-128-gcm"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"data":[{"id":1,"port":443,"cipher":"%s","secret":"x"}]}`, cipher)
+	}))
+	defer server.Close()
+	client, err := v2board.New(&api.Config{
+		APIHost:  server.URL,
+		Key:      "qwertyuiopasdfghjkl",
+		NodeID:   1,
+		NodeType: "Shadowsocks",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := client.Events()
+	for _, cipher = range []string{"aes-128-gcm", "chacha20-ietf-poly1305"} {
+		nodeInfo, err := client.GetNodeInfo(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeInfo.CypherMethod != cipher || nodeInfo.TransportProtocol != "tcp" {
+			t.Errorf("got %s over %s, want %s over tcp", nodeInfo.CypherMethod, nodeInfo.TransportProtocol, cipher)
+		}
+	}
+	changed := false
+	for len(events) > 0 {
+		if event := <-events; event.Type == api.NodeChanged {
+			changed = event.NodeInfo.CypherMethod == "chacha20-ietf-poly1305"
+		}
+	}
+	if !changed {
+		t.Error("expected a NodeChanged event for the new cipher")
+	}
+}
+
+func TestV2rayNodeInfoSkipsETag(t *testing.T) {
+	alterID := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/server/Deepbwork/user" {
+			fmt.Fprintf(w, `{"data":[{"id":1,"v2ray_user":{"uuid":"a","email":"a","alter_id":%d}}]}`, alterID)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, `{"inbound":{"port":443,"streamSettings":{"network":"tcp"}}}`)
+	}))
+	defer server.Close()
+	client, err := v2board.New(&api.Config{
+		APIHost:  server.URL,
+		Key:      "qwertyuiopasdfghjkl",
+		NodeID:   1,
+		NodeType: "V2ray",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alterID = range []int{0, 64} {
+		nodeInfo, err := client.GetNodeInfo(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeInfo.AlterID != alterID {
+			t.Errorf("AlterID = %d, want %d from the user list", nodeInfo.AlterID, alterID)
+		}
+	}
+}
+
+func TestNodeInfoSkipsUserListGuard(t *testing.T) {
+	users := `[{"id":1,"v2ray_user":{"uuid":"a"}},{"id":2,"v2ray_user":{"uuid":"b"}},{"id":3,"v2ray_user":{"uuid":"c"}},` +
+		`{"id":4,"v2ray_user":{"uuid":"d"}},{"id":5,"v2ray_user":{"uuid":"e"}}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/server/Deepbwork/user" {
+			fmt.Fprintf(w, `{"data":%s}`, users)
+			return
+		}
+		fmt.Fprint(w, `{"inbound":{"port":443,"streamSettings":{"network":"ws","wsSettings":{"path":"/v2ray"}}}}`)
+	}))
+	defer server.Close()
+	client, err := v2board.New(&api.Config{
+		APIHost:             server.URL,
+		Key:                 "qwertyuiopasdfghjkl",
+		NodeID:              1,
+		NodeType:            "V2ray",
+		RejectEmptyUserList: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := client.Events()
+	if _, err := client.GetNodeInfo(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if userList, err := client.GetUserList(context.Background()); err != nil || len(*userList) != 5 {
+		t.Fatalf("expected 5 users, got %v, %v", userList, err)
+	}
+
+	users = `[]`
+	// The node info reads the user list too, but only GetUserList checks it
+	if _, err := client.GetNodeInfo(context.Background()); err != nil {
+		t.Errorf("expected the node info to ignore the empty user list, got %v", err)
+	}
+	if _, err := client.GetUserList(context.Background()); !errors.Is(err, api.ErrSuspiciousEmptyList) {
+		t.Errorf("expected ErrSuspiciousEmptyList, got %v", err)
+	}
+
+	polls := make(map[string]int)
+	for len(events) > 0 {
+		event := <-events
+		polls[fmt.Sprintf("%s %s", event.Endpoint, event.Type)]++
+	}
+	want := map[string]int{"node_info poll succeeded": 2, "user_list poll succeeded": 1, "user_list poll failed": 1}
+	for poll, count := range want {
+		if polls[poll] != count {
+			t.Errorf("expected %d %s events, got %v", count, poll, polls)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// ResolveHost looks up the host of an APIHost so the first panel request does not pay for DNS
+func ResolveHost(ctx context.Context, apiHost string) error {
+	if _, ok := UnixSocketPath(apiHost); ok {
+		return nil
+	}
+	u, err := url.Parse(apiHost)
+	if err != nil {
+		return fmt.Errorf("parse %s failed: %s", apiHost, err)
+	}
+	host := u.Hostname()
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return fmt.Errorf("resolve %s failed: %s", host, err)
+	}
+	return nil
+}
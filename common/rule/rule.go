@@ -3,6 +3,7 @@ package rule
 
 import (
 	"fmt"
+	"net"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -54,14 +55,14 @@ func (r *RuleManager) Detect(tag string, destination string, email string) (reje
 	if value, ok := r.InboundRule.Load(tag); ok {
 		ruleList := value.([]api.DetectRule)
 		for _, r := range ruleList {
-			if matchRule(r.Pattern, destination) {
+			if matchRule(r, destination) {
 				hitRuleID = r.ID
 				reject = true
 				break
 			}
 		}
-		// If we hit some rule
-		if reject && hitRuleID != -1 {
+		// If we hit some panel rule, local rules have nothing to report
+		if reject && !api.IsLocalRule(hitRuleID) {
 			l := strings.Split(email, "|")
 			uid, err := strconv.Atoi(l[len(l)-1])
 			if err != nil {
@@ -82,11 +83,42 @@ func (r *RuleManager) Detect(tag string, destination string, email string) (reje
 	return reject
 }
 
-func matchRule(rule string, destination string) (hit bool) {
+func matchRule(rule api.DetectRule, destination string) (hit bool) {
 	hit = false
+	switch rule.Type {
+	case api.RuleTypeDomain:
+		host := strings.ToLower(destinationHost(destination))
+		return host == rule.Pattern || strings.HasSuffix(host, "."+rule.Pattern)
+	case api.RuleTypeIPCIDR:
+		ipNet := rule.IPNet
+		if ipNet == nil {
+			var err error
+			if ipNet, err = api.ParseIPCIDR(rule.Pattern); err != nil {
+				return false
+			}
+		}
+		ip := net.ParseIP(destinationHost(destination))
+		return ip != nil && ipNet.Contains(ip)
+	}
+	// Reuse the regex compiled when the rule was loaded
+	re := rule.Regexp
+	if re == nil {
+		re = regexp.MustCompile(rule.Pattern)
+	}
 	// Check Regex
-	if regexp.MustCompile(rule).Match([]byte(destination)) {
+	if re.Match([]byte(destination)) {
 		return true
 	}
 	return hit
 }
+
+// destinationHost returns the host of a destination like tcp:example.com:443
+func destinationHost(destination string) string {
+	if i := strings.Index(destination, ":"); i >= 0 && (destination[:i] == "tcp" || destination[:i] == "udp") {
+		destination = destination[i+1:]
+	}
+	if host, _, err := net.SplitHostPort(destination); err == nil {
+		return host
+	}
+	return destination
+}
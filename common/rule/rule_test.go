@@ -0,0 +1,29 @@
+package rule
+
+import (
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestMatchRuleTypes(t *testing.T) {
+	cases := []struct {
+		rule        api.DetectRule
+		destination string
+		hit         bool
+	}{
+		{api.DetectRule{Pattern: "baidu.com"}, "tcp:www.baidu.com:443", true},
+		{api.DetectRule{Type: api.RuleTypeDomain, Pattern: "baidu.com"}, "tcp:www.baidu.com:443", true},
+		{api.DetectRule{Type: api.RuleTypeDomain, Pattern: "baidu.com"}, "tcp:BAIDU.COM:80", true},
+		{api.DetectRule{Type: api.RuleTypeDomain, Pattern: "baidu.com"}, "tcp:notbaidu.com:443", false},
+		{api.DetectRule{Type: api.RuleTypeIPCIDR, Pattern: "10.0.0.0/8"}, "udp:10.1.2.3:53", true},
+		{api.DetectRule{Type: api.RuleTypeIPCIDR, Pattern: "10.0.0.0/8"}, "tcp:11.1.2.3:443", false},
+		{api.DetectRule{Type: api.RuleTypeIPCIDR, Pattern: "fd00::/8"}, "tcp:[fd00::1]:443", true},
+		{api.DetectRule{Type: api.RuleTypeIPCIDR, Pattern: "10.0.0.0/8"}, "tcp:10.example.com:443", false},
+	}
+	for _, c := range cases {
+		if hit := matchRule(c.rule, c.destination); hit != c.hit {
+			t.Errorf("matchRule(%s %s, %s) = %v, want %v", c.rule.Type, c.rule.Pattern, c.destination, hit, c.hit)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package serverstatus
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/shirou/gopsutil/cpu"
@@ -32,3 +35,22 @@ func GetSystemInfo() (Cpu float64, Mem float64, Disk float64, Uptime int, err er
 	Uptime = int(time.Since(upTime).Seconds())
 	return cpuUsage[0], memUsage.UsedPercent, diskUsage.UsedPercent, Uptime, nil
 }
+
+// DefaultThermalPath is the thermal zone of the SoC on most Linux edge boxes
+const DefaultThermalPath = "/sys/class/thermal/thermal_zone0/temp"
+
+// GetCPUTemp reads the CPU temperature in Celsius from a thermal zone file, which holds millidegrees
+func GetCPUTemp(path string) (float64, error) {
+	if path == "" {
+		path = DefaultThermalPath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("read cpu temperature failed: %s", err)
+	}
+	milliCelsius, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse cpu temperature failed: %s", err)
+	}
+	return milliCelsius / 1000, nil
+}
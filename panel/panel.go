@@ -7,10 +7,10 @@ import (
 	"sync"
 
 	"github.com/XrayR-project/XrayR/api"
-	"github.com/XrayR-project/XrayR/api/pmpanel"
-	"github.com/XrayR-project/XrayR/api/proxypanel"
-	"github.com/XrayR-project/XrayR/api/sspanel"
-	"github.com/XrayR-project/XrayR/api/v2board"
+	_ "github.com/XrayR-project/XrayR/api/pmpanel"
+	_ "github.com/XrayR-project/XrayR/api/proxypanel"
+	_ "github.com/XrayR-project/XrayR/api/sspanel"
+	_ "github.com/XrayR-project/XrayR/api/v2board"
 	"github.com/XrayR-project/XrayR/app/mydispatcher"
 	_ "github.com/XrayR-project/XrayR/main/distro/all"
 	"github.com/XrayR-project/XrayR/service"
@@ -141,18 +141,9 @@ func (p *Panel) Start() {
 	p.Server = server
 	// Load Nodes config
 	for _, nodeConfig := range p.panelConfig.NodesConfig {
-		var apiClient api.API
-		switch nodeConfig.PanelType {
-		case "SSpanel":
-			apiClient = sspanel.New(nodeConfig.ApiConfig)
-		case "V2board":
-			apiClient = v2board.New(nodeConfig.ApiConfig)
-		case "PMpanel":
-			apiClient = pmpanel.New(nodeConfig.ApiConfig)
-		case "Proxypanel":
-			apiClient = proxypanel.New(nodeConfig.ApiConfig)
-		default:
-			log.Panicf("Unsupport panel type: %s", nodeConfig.PanelType)
+		apiClient, err := api.New(nodeConfig.PanelType, nodeConfig.ApiConfig)
+		if err != nil {
+			log.Panicf("Failed to create the %s api client: %s", nodeConfig.PanelType, err)
 		}
 		var controllerService service.Service
 		// Regist controller service
@@ -4,6 +4,7 @@ type Config struct {
 	ListenIP             string            `mapstructure:"ListenIP"`
 	SendIP               string            `mapstructure:"SendIP"`
 	UpdatePeriodic       int               `mapstructure:"UpdatePeriodic"`
+	NodeInfoDwellTime    int               `mapstructure:"NodeInfoDwellTime"`
 	CertConfig           *CertConfig       `mapstructure:"CertConfig"`
 	EnableDNS            bool              `mapstructure:"EnableDNS"`
 	DNSType              string            `mapstructure:"DNSType"`
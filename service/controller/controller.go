@@ -1,6 +1,8 @@
 package controller
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"reflect"
@@ -24,14 +26,22 @@ type Controller struct {
 	userList                *[]api.UserInfo
 	nodeInfoMonitorPeriodic *task.Periodic
 	userReportPeriodic      *task.Periodic
+	nodeInfoDebouncer       *nodeInfoDebouncer
+	ctx                     context.Context
+	cancel                  context.CancelFunc
 }
 
 // New return a Controller service with default parameters.
 func New(server *core.Instance, api api.API, config *Config) *Controller {
+	// Cancelled on Close, so in-flight panel requests do not delay the shutdown
+	ctx, cancel := context.WithCancel(context.Background())
 	controller := &Controller{
-		server:    server,
-		config:    config,
-		apiClient: api,
+		ctx:               ctx,
+		cancel:            cancel,
+		server:            server,
+		config:            config,
+		apiClient:         api,
+		nodeInfoDebouncer: newNodeInfoDebouncer(time.Duration(config.NodeInfoDwellTime) * time.Second),
 	}
 	return controller
 }
@@ -40,7 +50,7 @@ func New(server *core.Instance, api api.API, config *Config) *Controller {
 func (c *Controller) Start() error {
 	c.clientInfo = c.apiClient.Describe()
 	// First fetch Node Info
-	newNodeInfo, err := c.apiClient.GetNodeInfo()
+	newNodeInfo, err := c.apiClient.GetNodeInfo(c.ctx)
 	if err != nil {
 		return err
 	}
@@ -51,7 +61,7 @@ func (c *Controller) Start() error {
 		return err
 	}
 	// Update user
-	userInfo, err := c.apiClient.GetUserList()
+	userInfo, err := c.apiClient.GetUserList(c.ctx)
 	if err != nil {
 		return err
 	}
@@ -69,8 +79,8 @@ func (c *Controller) Start() error {
 	}
 	// Add Rule Manager
 	if !c.config.DisableGetRule {
-		if ruleList, err := c.apiClient.GetNodeRule(); err != nil {
-			log.Printf("Get rule list filed: %s", err)
+		if ruleList, err := c.apiClient.GetNodeRule(c.ctx); err != nil {
+			api.PanelErrorLogger.Print("Get rule list filed: ", err)
 		} else if len(*ruleList) > 0 {
 			if err := c.UpdateRule(c.Tag, *ruleList); err != nil {
 				log.Print(err)
@@ -94,6 +104,7 @@ func (c *Controller) Start() error {
 
 // Close implement the Close() function of the service interface
 func (c *Controller) Close() error {
+	c.cancel()
 	if c.nodeInfoMonitorPeriodic != nil {
 		err := c.nodeInfoMonitorPeriodic.Close()
 		if err != nil {
@@ -107,27 +118,33 @@ func (c *Controller) Close() error {
 			log.Panicf("user report periodic close failed: %s", err)
 		}
 	}
+	// Report the panel errors suppressed since they were last logged
+	api.PanelErrorLogger.Flush()
 	return nil
 }
 
 func (c *Controller) nodeInfoMonitor() (err error) {
 	// First fetch Node Info
-	newNodeInfo, err := c.apiClient.GetNodeInfo()
-	if err != nil {
-		log.Print(err)
+	newNodeInfo, err := c.apiClient.GetNodeInfo(c.ctx)
+	if err != nil && !errors.Is(err, api.ErrNodeInfoNotModified) {
+		api.PanelErrorLogger.Print(err)
 		return nil
 	}
 
 	// Update User
-	newUserInfo, err := c.apiClient.GetUserList()
+	newUserInfo, err := c.apiClient.GetUserList(c.ctx)
 	if err != nil {
-		log.Print(err)
+		api.PanelErrorLogger.Print(err)
 		return nil
 	}
 
 	var nodeInfoChanged bool = false
 	// If nodeInfo changed
-	if !reflect.DeepEqual(c.nodeInfo, newNodeInfo) {
+	if reflect.DeepEqual(c.nodeInfo, newNodeInfo) {
+		c.nodeInfoDebouncer.Reset()
+	} else if !c.nodeInfoDebouncer.Stable(newNodeInfo) {
+		log.Printf("Node info changed, wait %d sec for it to be stable", c.config.NodeInfoDwellTime)
+	} else {
 		// Remove old tag
 		oldtag := c.Tag
 		err := c.removeOldTag(oldtag)
@@ -160,8 +177,8 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 
 	// Check Rule
 	if !c.config.DisableGetRule {
-		if ruleList, err := c.apiClient.GetNodeRule(); err != nil {
-			log.Printf("Get rule list filed: %s", err)
+		if ruleList, err := c.apiClient.GetNodeRule(c.ctx); err != nil {
+			api.PanelErrorLogger.Print("Get rule list filed: ", err)
 		} else if len(*ruleList) > 0 {
 			if err := c.UpdateRule(c.Tag, *ruleList); err != nil {
 				log.Print(err)
@@ -170,7 +187,7 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 	}
 
 	// Check Cert
-	if c.nodeInfo.EnableTLS && (c.config.CertConfig.CertMode == "dns" || c.config.CertConfig.CertMode == "http") {
+	if c.nodeInfo.TLS().Enable && (c.config.CertConfig.CertMode == "dns" || c.config.CertConfig.CertMode == "http") {
 		lego, err := legocmd.New()
 		if err != nil {
 			log.Print(err)
@@ -266,6 +283,7 @@ func (c *Controller) addInboundForSSPlugin(newNodeInfo api.NodeInfo) (err error)
 	fakeNodeInfo := newNodeInfo
 	fakeNodeInfo.TransportProtocol = "tcp"
 	fakeNodeInfo.EnableTLS = false
+	fakeNodeInfo.TLSSettings.Enable = false
 	// Add a regular Shadowsocks inbound and outbound
 	inboundConfig, err := InboundBuilder(c.config, &fakeNodeInfo)
 	if err != nil {
@@ -381,7 +399,7 @@ func (c *Controller) userInfoMonitor() (err error) {
 	if err != nil {
 		log.Print(err)
 	}
-	err = c.apiClient.ReportNodeStatus(
+	err = c.apiClient.ReportNodeStatus(c.ctx,
 		&api.NodeStatus{
 			CPU:    CPU,
 			Mem:    Mem,
@@ -389,7 +407,7 @@ func (c *Controller) userInfoMonitor() (err error) {
 			Uptime: Uptime,
 		})
 	if err != nil {
-		log.Print(err)
+		api.PanelErrorLogger.Print(err)
 	}
 
 	// Get User traffic
@@ -405,28 +423,26 @@ func (c *Controller) userInfoMonitor() (err error) {
 		}
 	}
 	if len(userTraffic) > 0 && !c.config.DisableUploadTraffic {
-		err = c.apiClient.ReportUserTraffic(&userTraffic)
+		err = c.apiClient.ReportUserTraffic(c.ctx, &userTraffic)
 		if err != nil {
-			log.Print(err)
+			api.PanelErrorLogger.Print(err)
 		}
 	}
 
-	// Report Online info
+	// Report Online info, even when no IP is connected now, as the client merges the IPs seen within OnlineWindow
 	if onlineDevice, err := c.GetOnlineDevice(c.Tag); err != nil {
 		log.Print(err)
+	} else if err = c.apiClient.ReportNodeOnlineUsers(c.ctx, onlineDevice); err != nil {
+		api.PanelErrorLogger.Print(err)
 	} else if len(*onlineDevice) > 0 {
-		if err = c.apiClient.ReportNodeOnlineUsers(onlineDevice); err != nil {
-			log.Print(err)
-		} else {
-			log.Printf("Report %d online users", len(*onlineDevice))
-		}
+		log.Printf("Report %d online users", len(*onlineDevice))
 	}
 	// Report Illegal user
 	if detectResult, err := c.GetDetectResult(c.Tag); err != nil {
 		log.Print(err)
 	} else if len(*detectResult) > 0 {
-		if err = c.apiClient.ReportIllegal(detectResult); err != nil {
-			log.Print(err)
+		if err = c.apiClient.ReportIllegal(c.ctx, detectResult); err != nil {
+			api.PanelErrorLogger.Print(err)
 		} else {
 			log.Printf("Report %d illegal behaviors", len(*detectResult))
 		}
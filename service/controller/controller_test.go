@@ -61,7 +61,10 @@ func TestController(t *testing.T) {
 		NodeID:   41,
 		NodeType: "V2ray",
 	}
-	apiclient := sspanel.New(apiConfig)
+	apiclient, err := sspanel.New(apiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
 	c := New(server, apiclient, controlerconfig)
 	fmt.Println("Sleep 1s")
 	err = c.Start()
@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// nodeInfoDebouncer holds back a changed node info until it stays the same for the dwell time,
+// so a flapping panel field does not restart the inbound on every poll
+type nodeInfoDebouncer struct {
+	dwell   time.Duration
+	pending *api.NodeInfo
+	since   time.Time
+	now     func() time.Time
+}
+
+func newNodeInfoDebouncer(dwell time.Duration) *nodeInfoDebouncer {
+	return &nodeInfoDebouncer{dwell: dwell, now: time.Now}
+}
+
+// Stable reports whether the changed node info has been the same for the dwell time
+func (d *nodeInfoDebouncer) Stable(newNodeInfo *api.NodeInfo) bool {
+	if d.dwell <= 0 {
+		return true
+	}
+	now := d.now()
+	if d.pending == nil || !reflect.DeepEqual(d.pending, newNodeInfo) {
+		d.pending = newNodeInfo
+		d.since = now
+		return false
+	}
+	if now.Sub(d.since) < d.dwell {
+		return false
+	}
+	d.Reset()
+	return true
+}
+
+// Reset drops the pending node info, e.g. when the panel goes back to the applied one
+func (d *nodeInfoDebouncer) Reset() {
+	d.pending = nil
+}
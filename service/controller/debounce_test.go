@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestNodeInfoDebouncer(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := newNodeInfoDebouncer(3 * time.Minute)
+	d.now = func() time.Time { return now }
+
+	// The panel flaps the port on every poll
+	for i := 0; i < 10; i++ {
+		if d.Stable(&api.NodeInfo{Port: 443 + i%2}) {
+			t.Fatalf("flapping node info applied at poll %d", i)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	// Then settles on a single value
+	var applied []int
+	for i := 0; i < 5; i++ {
+		nodeInfo := &api.NodeInfo{Port: 8443}
+		if d.Stable(nodeInfo) {
+			applied = append(applied, nodeInfo.Port)
+		}
+		now = now.Add(time.Minute)
+	}
+	if len(applied) != 1 || applied[0] != 8443 {
+		t.Errorf("expected the stable value to be applied once, got %v", applied)
+	}
+}
+
+func TestNodeInfoDebouncerDisabled(t *testing.T) {
+	d := newNodeInfoDebouncer(0)
+	if !d.Stable(&api.NodeInfo{Port: 443}) {
+		t.Error("a zero dwell time should apply changes immediately")
+	}
+}
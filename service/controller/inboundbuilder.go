@@ -145,7 +145,10 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo) (*core.InboundHandle
 		}
 		streamSetting.WSSettings = wsSettings
 	} else if networkType == "http" {
-		hosts := conf.StringList{nodeInfo.Host}
+		hosts := conf.StringList(nodeInfo.Hosts)
+		if len(hosts) == 0 {
+			hosts = conf.StringList{nodeInfo.Host}
+		}
 		httpSettings := &conf.HTTPConfig{
 			Host: &hosts,
 			Path: nodeInfo.Path,
@@ -160,18 +163,19 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo) (*core.InboundHandle
 
 	streamSetting.Network = &transportProtocol
 	// Build TLS and XTLS settings
-	if nodeInfo.EnableTLS && config.CertConfig.CertMode != "none" {
-		streamSetting.Security = nodeInfo.TLSType
+	nodeTLS := nodeInfo.TLS()
+	if nodeTLS.Enable && config.CertConfig.CertMode != "none" {
+		streamSetting.Security = nodeTLS.Type
 		certFile, keyFile, err := getCertFile(config.CertConfig)
 		if err != nil {
 			return nil, err
 		}
-		if nodeInfo.TLSType == "tls" {
+		if nodeTLS.Type == "tls" {
 			tlsSettings := &conf.TLSConfig{}
 			tlsSettings.Certs = append(tlsSettings.Certs, &conf.TLSCertConfig{CertFile: certFile, KeyFile: keyFile, OcspStapling: 3600})
 
 			streamSetting.TLSSettings = tlsSettings
-		} else if nodeInfo.TLSType == "xtls" {
+		} else if nodeTLS.Type == "xtls" {
 			xtlsSettings := &conf.XTLSConfig{}
 			xtlsSettings.Certs = append(xtlsSettings.Certs, &conf.XTLSCertConfig{CertFile: certFile, KeyFile: keyFile, OcspStapling: 3600})
 			streamSetting.XTLSSettings = xtlsSettings